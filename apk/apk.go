@@ -0,0 +1,219 @@
+package apk
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/joeleonjr/apkdig"
+	"github.com/joeleonjr/apkdig/arsc"
+	"github.com/joeleonjr/apkdig/dex"
+)
+
+// ManifestPath is the fixed zip entry name Android expects the binary XML
+// manifest to live under.
+const ManifestPath = "AndroidManifest.xml"
+
+// ResourcesPath is the fixed zip entry name Android expects the compiled
+// resource table to live under.
+const ResourcesPath = "resources.arsc"
+
+// APK is a thin wrapper around an opened .apk (itself just a zip file) that
+// knows how to find and decode the pieces apkdig cares about.
+type APK struct {
+	path string
+	zr   *zip.ReadCloser
+}
+
+// OpenAPK opens the .apk at path for reading.
+func OpenAPK(path string) (*APK, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	return &APK{path: path, zr: zr}, nil
+}
+
+// Close releases the underlying zip file.
+func (a *APK) Close() error {
+	return a.zr.Close()
+}
+
+func (a *APK) find(name string) (*zip.File, error) {
+	for _, f := range a.zr.File {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("apk: %s has no %s entry", a.path, name)
+}
+
+// Manifest reads and parses AndroidManifest.xml from the apk.
+func (a *APK) Manifest() (apkdig.AXML, error) {
+	f, err := a.find(ManifestPath)
+	if err != nil {
+		return apkdig.AXML{}, err
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return apkdig.AXML{}, err
+	}
+	return apkdig.ReadAXML(bytes.NewReader(data))
+}
+
+// Resources reads and parses resources.arsc from the apk.
+func (a *APK) Resources() (*arsc.ARSC, error) {
+	f, err := a.find(ResourcesPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return arsc.ReadARSC(bytes.NewReader(data))
+}
+
+// DexFiles returns a reader for every classes*.dex entry in the apk, in the
+// order they appear in the central directory. Callers are responsible for
+// closing each one.
+func (a *APK) DexFiles() ([]io.ReadCloser, error) {
+	var dexes []io.ReadCloser
+	for _, f := range a.zr.File {
+		if !isDexEntry(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		dexes = append(dexes, rc)
+	}
+	return dexes, nil
+}
+
+// Signature is a single signing-certificate file found under META-INF/.
+type Signature struct {
+	Name string
+	Data []byte
+}
+
+// Signatures returns the .RSA/.DSA/.EC certificate files bundled under
+// META-INF/ by the apk signing tool.
+func (a *APK) Signatures() ([]Signature, error) {
+	var sigs []Signature
+	for _, f := range a.zr.File {
+		if !strings.HasPrefix(f.Name, "META-INF/") {
+			continue
+		}
+		switch strings.ToUpper(path.Ext(f.Name)) {
+		case ".RSA", ".DSA", ".EC":
+		default:
+			continue
+		}
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, Signature{Name: f.Name, Data: data})
+	}
+	return sigs, nil
+}
+
+// Rewrite streams every entry of the apk into a new zip at dst, letting
+// mutateManifest patch the parsed manifest tree before it replaces the
+// original AndroidManifest.xml entry, and mutateDex patch each parsed
+// classes*.dex before it replaces its own entry. Either callback may be
+// nil to leave that kind of entry untouched. Every other entry is copied
+// through unchanged.
+//
+// A mutateDex that calls (*dex.DEX).AddString/AddMethod produces a dex
+// whose id tables are no longer sorted the way ART's verifier requires; see
+// the warning on (*dex.DEX).Marshal before shipping a Rewrite-patched apk
+// to a device.
+func (a *APK) Rewrite(dst string, mutateManifest func(*apkdig.AXML) error, mutateDex func(*dex.DEX) error) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := zip.NewWriter(out)
+	for _, f := range a.zr.File {
+		data, err := readZipFile(f)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.Name == ManifestPath && mutateManifest != nil:
+			manifest, err := apkdig.ReadAXML(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			if err := mutateManifest(&manifest); err != nil {
+				return err
+			}
+			if data, err = manifest.MarshalBinary(); err != nil {
+				return err
+			}
+
+		case isDexEntry(f.Name) && mutateDex != nil:
+			d, err := dex.ReadDEX(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			if err := mutateDex(d); err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			if err := d.Marshal(&buf); err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		}
+
+		header := f.FileHeader
+		w, err := zw.CreateHeader(&header)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func isDexEntry(name string) bool {
+	return strings.HasPrefix(name, "classes") && strings.HasSuffix(name, ".dex")
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
@@ -0,0 +1,217 @@
+package apk
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/joeleonjr/apkdig"
+	"github.com/joeleonjr/apkdig/dex"
+)
+
+func uleb128(v uint32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+		} else {
+			return append(out, b)
+		}
+	}
+}
+
+func stringDataItem(s string) []byte {
+	buf := uleb128(uint32(len(utf16.Encode([]rune(s)))))
+	buf = append(buf, []byte(s)...)
+	return append(buf, 0)
+}
+
+// buildMinimalDEX returns a syntactically valid classes.dex with one string
+// and one type referencing it, mirroring the dex package's own test fixture
+// (dex.headerSize/magicPrefix aren't exported, so the layout is repeated
+// here rather than shared).
+func buildMinimalDEX() []byte {
+	const headerSize = 0x70
+	strs := []string{"Lcom/example/Foo;"}
+	stringIdsOff := uint32(headerSize)
+	typeIdsOff := stringIdsOff + 4*uint32(len(strs))
+	dataOff := typeIdsOff + 4
+
+	var data bytes.Buffer
+	stringOff := dataOff + uint32(data.Len())
+	data.Write(stringDataItem(strs[0]))
+
+	var header bytes.Buffer
+	header.Write([]byte("dex\n"))
+	header.Write([]byte("035\x00"))
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // checksum
+	header.Write(make([]byte, 20))                        // signature
+	fileSize := dataOff + uint32(data.Len())
+	binary.Write(&header, binary.LittleEndian, fileSize)
+	binary.Write(&header, binary.LittleEndian, uint32(headerSize))
+	binary.Write(&header, binary.LittleEndian, uint32(0x12345678))
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // link_size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // link_off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // map_off
+	binary.Write(&header, binary.LittleEndian, uint32(len(strs)))
+	binary.Write(&header, binary.LittleEndian, stringIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(1))
+	binary.Write(&header, binary.LittleEndian, typeIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // proto_ids size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // proto_ids off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // field_ids size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // field_ids off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // method_ids size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // method_ids off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // class_defs size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // class_defs off
+	binary.Write(&header, binary.LittleEndian, uint32(data.Len()))
+	binary.Write(&header, binary.LittleEndian, dataOff)
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, stringOff)
+	binary.Write(&body, binary.LittleEndian, uint32(0)) // type_ids[0].descriptor_idx
+	body.Write(data.Bytes())
+
+	return append(header.Bytes(), body.Bytes()...)
+}
+
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("os.Create: %v", err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("zip.Create(%q): %v", name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("write %q: %v", name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("zip.Close: %v", err)
+	}
+}
+
+// TestRewrite builds a minimal apk, patches its manifest and classes.dex via
+// Rewrite, and checks that the patch landed in the output, the dex still
+// parses with ReadDEX and holds the added method, and the untouched zip entry
+// was copied through byte-for-byte.
+func TestRewrite(t *testing.T) {
+	manifest := apkdig.AXML{Root: &apkdig.AXMLNode{Name: "manifest"}}
+	manifestBytes, err := manifest.MarshalBinary()
+	if err != nil {
+		t.Fatalf("AXML.MarshalBinary: %v", err)
+	}
+	assetBytes := []byte("unrelated asset data")
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "in.apk")
+	writeZip(t, src, map[string][]byte{
+		ManifestPath:     manifestBytes,
+		"classes.dex":    buildMinimalDEX(),
+		"assets/foo.txt": assetBytes,
+	})
+
+	a, err := OpenAPK(src)
+	if err != nil {
+		t.Fatalf("OpenAPK: %v", err)
+	}
+	defer a.Close()
+
+	dst := filepath.Join(dir, "out.apk")
+	err = a.Rewrite(dst,
+		func(m *apkdig.AXML) error {
+			m.Root.Attributes = append(m.Root.Attributes, apkdig.AXMLAttribute{
+				Name:  "package",
+				Value: apkdig.AttrValue{Type: apkdig.ATTR_TYPE_STRING, Str: "com.example.patched"},
+			})
+			return nil
+		},
+		func(d *dex.DEX) error {
+			d.AddMethod("Lcom/example/Foo;", "<clinit>", "V")
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("Rewrite: %v", err)
+	}
+
+	out, err := OpenAPK(dst)
+	if err != nil {
+		t.Fatalf("OpenAPK(rewritten): %v", err)
+	}
+	defer out.Close()
+
+	gotManifest, err := out.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest: %v", err)
+	}
+	if len(gotManifest.Root.Attributes) != 1 || gotManifest.Root.Attributes[0].Value.Str != "com.example.patched" {
+		t.Errorf("rewritten manifest attributes = %+v, want one package=com.example.patched", gotManifest.Root.Attributes)
+	}
+
+	dexes, err := out.DexFiles()
+	if err != nil {
+		t.Fatalf("DexFiles: %v", err)
+	}
+	if len(dexes) != 1 {
+		t.Fatalf("DexFiles returned %d entries, want 1", len(dexes))
+	}
+	dexData, err := io.ReadAll(dexes[0])
+	if err != nil {
+		t.Fatalf("reading dex entry: %v", err)
+	}
+	dexes[0].Close()
+	d, err := dex.ReadDEX(bytes.NewReader(dexData))
+	if err != nil {
+		t.Fatalf("ReadDEX(rewritten): %v", err)
+	}
+	if len(d.MethodIds) != 1 {
+		t.Fatalf("rewritten dex has %d methods, want 1", len(d.MethodIds))
+	}
+	if name := d.StringIds[d.MethodIds[0].NameIdx].Value; name != "<clinit>" {
+		t.Errorf("rewritten dex method name = %q, want %q", name, "<clinit>")
+	}
+
+	gotAsset, err := out.find("assets/foo.txt")
+	if err != nil {
+		t.Fatalf("find(assets/foo.txt): %v", err)
+	}
+	assetData, err := readZipFile(gotAsset)
+	if err != nil {
+		t.Fatalf("readZipFile: %v", err)
+	}
+	if !bytes.Equal(assetData, assetBytes) {
+		t.Errorf("passthrough asset = %q, want %q", assetData, assetBytes)
+	}
+}
@@ -0,0 +1,413 @@
+package arsc
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	"github.com/joeleonjr/apkdig/axml"
+)
+
+// Chunk type identifiers for resources.arsc. CHUNK_STRINGS (0x001C0001) is
+// the same string-pool chunk AndroidManifest.xml uses, so it is decoded by
+// axml.StringPoolBlock rather than a second copy of that format here.
+const (
+	RES_TABLE_TYPE           = 0x0002
+	RES_TABLE_PACKAGE_TYPE   = 0x0200
+	RES_TABLE_TYPE_SPEC_TYPE = 0x0202
+	RES_TABLE_TYPE_TYPE      = 0x0201
+
+	flagComplex = 0x0001
+)
+
+// ResTableConfig is the subset of Android's ResTable_config this package
+// understands: enough to tell the "default" (no qualifiers) configuration
+// apart from a language/region-specific one.
+type ResTableConfig struct {
+	Language string
+	Country  string
+}
+
+// DefaultConfig is the unqualified configuration almost every resource ships
+// a value for (e.g. values/strings.xml, as opposed to values-fr/strings.xml).
+var DefaultConfig = ResTableConfig{}
+
+// Value is a single resolved resource value.
+type Value struct {
+	// Type is the Res_value dataType byte; TypeString means Str holds the
+	// resolved text, anything else means Data holds the raw 32-bit payload
+	// (an int, a color, a further reference, ...).
+	Type uint8
+	Data uint32
+	Str  string
+}
+
+// TypeString is the Res_value dataType for a value that indexes into a
+// package's global string pool.
+const TypeString = 0x03
+
+type entry struct {
+	config ResTableConfig
+	value  Value
+}
+
+// Package is one RES_TABLE_PACKAGE_TYPE chunk: a named, numbered group of
+// resource types (string, layout, drawable, ...) and their entries.
+type Package struct {
+	ID          uint32
+	Name        string
+	TypeStrings *axml.StringPoolBlock
+	KeyStrings  *axml.StringPoolBlock
+
+	// entries[typeIndex][entryIndex] holds every configuration this package
+	// has a value for, in the order they were read.
+	entries map[uint32]map[uint32][]entry
+}
+
+// ARSC is a parsed resources.arsc: a global string pool shared by every
+// package, plus the packages themselves.
+type ARSC struct {
+	Strings  *axml.StringPoolBlock
+	Packages []*Package
+}
+
+// ReadARSC parses a resources.arsc file.
+func ReadARSC(reader io.ReadSeeker) (*ARSC, error) {
+	var blocktype, size uint32
+	if err := binary.Read(reader, binary.LittleEndian, &blocktype); err != nil {
+		return nil, err
+	}
+	if blocktype != RES_TABLE_TYPE {
+		return nil, fmt.Errorf("Expected type=%X, got type=%X", RES_TABLE_TYPE, blocktype)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+		return nil, err
+	}
+	var packageCount uint32
+	if err := binary.Read(reader, binary.LittleEndian, &packageCount); err != nil {
+		return nil, err
+	}
+
+	table := &ARSC{}
+	for offset := uint32(12); offset < size; {
+		chunkStart := int64(offset)
+		var chunkType, chunkSize uint32
+		if err := binary.Read(reader, binary.LittleEndian, &chunkType); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(reader, binary.LittleEndian, &chunkSize); err != nil {
+			return nil, err
+		}
+		switch chunkType {
+		case axml.CHUNK_STRINGS:
+			if _, err := reader.Seek(chunkStart, io.SeekStart); err != nil {
+				return nil, err
+			}
+			data := make([]byte, chunkSize)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return nil, err
+			}
+			pool := &axml.StringPoolBlock{}
+			if err := pool.UnmarshalBinary(data); err != nil {
+				return nil, err
+			}
+			table.Strings = pool
+		case RES_TABLE_PACKAGE_TYPE:
+			if _, err := reader.Seek(chunkStart, io.SeekStart); err != nil {
+				return nil, err
+			}
+			data := make([]byte, chunkSize)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return nil, err
+			}
+			pkg, err := readPackage(data, table.Strings)
+			if err != nil {
+				return nil, err
+			}
+			table.Packages = append(table.Packages, pkg)
+		default:
+			return nil, fmt.Errorf("arsc: unknown chunk type %X", chunkType)
+		}
+		offset += chunkSize
+		if _, err := reader.Seek(int64(offset), io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+func readPackage(data []byte, globalStrings *axml.StringPoolBlock) (*Package, error) {
+	r := newByteReader(data)
+	var chunkType, chunkSize uint32
+	r.read(&chunkType)
+	r.read(&chunkSize)
+	if chunkType != RES_TABLE_PACKAGE_TYPE {
+		return nil, fmt.Errorf("Expected type=%X, got type=%X", RES_TABLE_PACKAGE_TYPE, chunkType)
+	}
+	pkg := &Package{entries: map[uint32]map[uint32][]entry{}}
+	r.read(&pkg.ID)
+	var rawName [128]uint16
+	r.read(&rawName)
+	pkg.Name = utf16ToString(rawName[:])
+	var typeStringsOffset, lastPublicType, keyStringsOffset, lastPublicKey uint32
+	r.read(&typeStringsOffset)
+	r.read(&lastPublicType)
+	r.read(&keyStringsOffset)
+	r.read(&lastPublicKey)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	for offset := r.pos(); uint32(offset) < chunkSize; {
+		chunkStart := offset
+		var ct, cs uint32
+		if err := binary.Read(r.r, binary.LittleEndian, &ct); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r.r, binary.LittleEndian, &cs); err != nil {
+			return nil, err
+		}
+		body := data[chunkStart : chunkStart+int64(cs)]
+		switch ct {
+		case axml.CHUNK_STRINGS:
+			pool := &axml.StringPoolBlock{}
+			if err := pool.UnmarshalBinary(body); err != nil {
+				return nil, err
+			}
+			if pkg.TypeStrings == nil {
+				pkg.TypeStrings = pool
+			} else {
+				pkg.KeyStrings = pool
+			}
+		case RES_TABLE_TYPE_SPEC_TYPE:
+			// Entry-presence flags, not needed to resolve a concrete value.
+		case RES_TABLE_TYPE_TYPE:
+			if err := readType(pkg, body, globalStrings); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("arsc: unknown package chunk type %X", ct)
+		}
+		offset = chunkStart + int64(cs)
+		if _, err := r.r.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	return pkg, nil
+}
+
+func readType(pkg *Package, data []byte, globalStrings *axml.StringPoolBlock) error {
+	r := newByteReader(data)
+	var chunkType, chunkSize uint32
+	r.read(&chunkType)
+	r.read(&chunkSize)
+	var id uint8
+	var res0 uint8
+	var res1 uint16
+	var entryCount, entriesStart uint32
+	r.read(&id)
+	r.read(&res0)
+	r.read(&res1)
+	r.read(&entryCount)
+	r.read(&entriesStart)
+
+	var configSize uint32
+	r.read(&configSize)
+	if configSize < 4 {
+		return fmt.Errorf("arsc: RES_TABLE_TYPE_TYPE config size %d smaller than its own 4-byte size field", configSize)
+	}
+	configBody := make([]byte, configSize-4)
+	r.readBytes(configBody)
+	if r.err != nil {
+		return r.err
+	}
+	config := decodeConfig(configBody)
+
+	offsets := make([]uint32, entryCount)
+	for i := range offsets {
+		r.read(&offsets[i])
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	typeIndex := uint32(id) - 1
+	if pkg.entries[typeIndex] == nil {
+		pkg.entries[typeIndex] = map[uint32][]entry{}
+	}
+	for entryIndex, entOffset := range offsets {
+		if entOffset == axml.SKIP_BLOCK {
+			continue
+		}
+		pos := int64(entriesStart) + int64(entOffset)
+		er := newByteReader(data[pos:])
+		var entSize, flags uint16
+		var key uint32
+		er.read(&entSize)
+		er.read(&flags)
+		er.read(&key)
+		if er.err != nil {
+			return er.err
+		}
+		if flags&flagComplex != 0 {
+			// Complex (map/bag) entries (styles, arrays, ...) aren't needed
+			// to resolve a simple string/int/color reference.
+			continue
+		}
+		var valSize uint16
+		var valRes0 uint8
+		var valType uint8
+		var valData uint32
+		er.read(&valSize)
+		er.read(&valRes0)
+		er.read(&valType)
+		er.read(&valData)
+		if er.err != nil {
+			return er.err
+		}
+		val := Value{Type: valType, Data: valData}
+		if valType == TypeString && globalStrings != nil && int(valData) < len(globalStrings.Strings) {
+			val.Str = globalStrings.Strings[valData]
+		}
+		pkg.entries[typeIndex][uint32(entryIndex)] = append(pkg.entries[typeIndex][uint32(entryIndex)], entry{config: config, value: val})
+	}
+	return nil
+}
+
+func decodeConfig(data []byte) ResTableConfig {
+	var config ResTableConfig
+	if len(data) >= 4 {
+		config.Language = decodeLocaleField(data[0:2])
+		config.Country = decodeLocaleField(data[2:4])
+	}
+	return config
+}
+
+func decodeLocaleField(b []byte) string {
+	if b[0] == 0 && b[1] == 0 {
+		return ""
+	}
+	return string([]byte{b[0], b[1]})
+}
+
+// Resolve looks up the value of id (a packageId<<24 | typeIndex<<16 |
+// entryIndex resource id) for config, falling back to DefaultConfig if no
+// value was published for config specifically.
+func (t *ARSC) Resolve(id uint32, config ResTableConfig) (Value, error) {
+	packageID := id >> 24
+	typeIndex := (id>>16)&0xFF - 1
+	entryIndex := id & 0xFFFF
+
+	for _, pkg := range t.Packages {
+		if pkg.ID != packageID {
+			continue
+		}
+		entries, ok := pkg.entries[typeIndex][entryIndex]
+		if !ok {
+			return Value{}, fmt.Errorf("arsc: no entry for resource id 0x%08X", id)
+		}
+		for _, e := range entries {
+			if e.config == config {
+				return e.value, nil
+			}
+		}
+		for _, e := range entries {
+			if e.config == DefaultConfig {
+				return e.value, nil
+			}
+		}
+		return entries[0].value, nil
+	}
+	return Value{}, fmt.Errorf("arsc: no package 0x%02X for resource id 0x%08X", packageID, id)
+}
+
+func utf16ToString(units []uint16) string {
+	for i, u := range units {
+		if u == 0 {
+			units = units[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// byteReader is a small helper around binary.Read that sticks the first
+// error it hits so a chain of reads can be checked once at the end.
+type byteReader struct {
+	r   *sliceReadSeeker
+	err error
+}
+
+func newByteReader(data []byte) *byteReader {
+	return &byteReader{r: &sliceReadSeeker{data: data}}
+}
+
+func (b *byteReader) read(v interface{}) {
+	if b.err != nil {
+		return
+	}
+	b.err = binary.Read(b.r, binary.LittleEndian, v)
+}
+
+func (b *byteReader) readBytes(v []byte) {
+	if b.err != nil {
+		return
+	}
+	_, b.err = io.ReadFull(b.r, v)
+}
+
+func (b *byteReader) pos() int64 {
+	pos, _ := b.r.Seek(0, io.SeekCurrent)
+	return pos
+}
+
+// sliceReadSeeker adapts a []byte to io.ReadSeeker without pulling in
+// bytes.Reader's value semantics, since readPackage/readType need to pass
+// the same backing slice to both binary.Read and raw slicing by offset.
+type sliceReadSeeker struct {
+	data []byte
+	pos  int64
+}
+
+func (s *sliceReadSeeker) Read(p []byte) (int, error) {
+	if s.pos >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[s.pos:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *sliceReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+		base = 0
+	case io.SeekCurrent:
+		base = s.pos
+	case io.SeekEnd:
+		base = int64(len(s.data))
+	default:
+		return 0, errors.New("arsc: invalid whence")
+	}
+	s.pos = base + offset
+	return s.pos, nil
+}
@@ -0,0 +1,159 @@
+package arsc
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/joeleonjr/apkdig/axml"
+)
+
+const typeInt = 0x10 // Res_value TYPE_INT_DEC; anything != TypeString.
+
+// resTableTypeChunk hand-builds one RES_TABLE_TYPE_TYPE chunk for typeID
+// (1-based) under config, with one simple int entry per (entryIndex, value)
+// pair in entries. A nil value at an index means that config has no entry
+// for it (encoded as axml.SKIP_BLOCK).
+func resTableTypeChunk(typeID uint8, config [4]byte, entries []*uint32) []byte {
+	entriesStart := uint32(28 + 4*len(entries))
+
+	var data bytes.Buffer
+	offsets := make([]uint32, len(entries))
+	entryOff := uint32(0)
+	for i, v := range entries {
+		if v == nil {
+			offsets[i] = axml.SKIP_BLOCK
+			continue
+		}
+		offsets[i] = entryOff
+		entryOff += 16
+		binary.Write(&data, binary.LittleEndian, uint16(8)) // entSize
+		binary.Write(&data, binary.LittleEndian, uint16(0)) // flags
+		binary.Write(&data, binary.LittleEndian, uint32(0)) // key
+		binary.Write(&data, binary.LittleEndian, uint16(8)) // valSize
+		binary.Write(&data, binary.LittleEndian, uint8(0))  // valRes0
+		binary.Write(&data, binary.LittleEndian, uint8(typeInt))
+		binary.Write(&data, binary.LittleEndian, *v)
+	}
+
+	chunkSize := entriesStart + uint32(data.Len())
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(RES_TABLE_TYPE_TYPE))
+	binary.Write(&buf, binary.LittleEndian, chunkSize)
+	binary.Write(&buf, binary.LittleEndian, typeID)
+	binary.Write(&buf, binary.LittleEndian, uint8(0))  // res0
+	binary.Write(&buf, binary.LittleEndian, uint16(0)) // res1
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	binary.Write(&buf, binary.LittleEndian, entriesStart)
+	binary.Write(&buf, binary.LittleEndian, uint32(8)) // configSize: size field + 4-byte language/country
+	buf.Write(config[:])
+	for _, off := range offsets {
+		binary.Write(&buf, binary.LittleEndian, off)
+	}
+	buf.Write(data.Bytes())
+	return buf.Bytes()
+}
+
+func emptyPool(t *testing.T) []byte {
+	t.Helper()
+	data, err := (&axml.StringPoolBlock{}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("StringPoolBlock.MarshalBinary: %v", err)
+	}
+	return data
+}
+
+// buildMinimalARSC returns a resources.arsc with one package (ID 1) holding
+// a single type (ID 1) with two entries: entry 0 has both a default-config
+// and an fr-config value, entry 1 has only an fr-config value. This is
+// enough to exercise every branch of Resolve's config fallback.
+func buildMinimalARSC(t *testing.T) []byte {
+	t.Helper()
+	v200, v100, v300 := uint32(200), uint32(100), uint32(300)
+
+	defaultConfig := [4]byte{}
+	frConfig := [4]byte{'f', 'r', 0, 0}
+	chunkDefault := resTableTypeChunk(1, defaultConfig, []*uint32{&v200, nil})
+	chunkFr := resTableTypeChunk(1, frConfig, []*uint32{&v100, &v300})
+
+	pool := emptyPool(t)
+
+	var pkgBody bytes.Buffer
+	pkgBody.Write(pool) // type strings
+	pkgBody.Write(pool) // key strings
+	pkgBody.Write(chunkDefault)
+	pkgBody.Write(chunkFr)
+
+	pkgHeaderSize := uint32(4 + 4 + 4 + 256 + 4 + 4 + 4 + 4)
+	pkgSize := pkgHeaderSize + uint32(pkgBody.Len())
+
+	var pkg bytes.Buffer
+	binary.Write(&pkg, binary.LittleEndian, uint32(RES_TABLE_PACKAGE_TYPE))
+	binary.Write(&pkg, binary.LittleEndian, pkgSize)
+	binary.Write(&pkg, binary.LittleEndian, uint32(1)) // package ID
+	pkg.Write(make([]byte, 256))                       // name, unused by Resolve
+	binary.Write(&pkg, binary.LittleEndian, uint32(0)) // typeStringsOffset
+	binary.Write(&pkg, binary.LittleEndian, uint32(0)) // lastPublicType
+	binary.Write(&pkg, binary.LittleEndian, uint32(0)) // keyStringsOffset
+	binary.Write(&pkg, binary.LittleEndian, uint32(0)) // lastPublicKey
+	pkg.Write(pkgBody.Bytes())
+
+	globalPool := emptyPool(t)
+	size := uint32(12+len(globalPool)) + uint32(pkg.Len())
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, uint32(RES_TABLE_TYPE))
+	binary.Write(&out, binary.LittleEndian, size)
+	binary.Write(&out, binary.LittleEndian, uint32(1)) // packageCount
+	out.Write(globalPool)
+	out.Write(pkg.Bytes())
+	return out.Bytes()
+}
+
+// TestResolveConfigFallback checks Resolve's three-tier lookup: an exact
+// config match, falling back to DefaultConfig, and falling back to
+// whichever config was read first when neither is present.
+func TestResolveConfigFallback(t *testing.T) {
+	table, err := ReadARSC(bytes.NewReader(buildMinimalARSC(t)))
+	if err != nil {
+		t.Fatalf("ReadARSC: %v", err)
+	}
+
+	fr := ResTableConfig{Language: "fr"}
+	de := ResTableConfig{Language: "de"}
+
+	const entry0 = 0x01010000 // package 1, type 1, entry 0
+	const entry1 = 0x01010001 // package 1, type 1, entry 1
+
+	if v, err := table.Resolve(entry0, fr); err != nil || v.Data != 100 {
+		t.Errorf("Resolve(entry0, fr) = %+v, %v; want Data=100, nil", v, err)
+	}
+	if v, err := table.Resolve(entry0, de); err != nil || v.Data != 200 {
+		t.Errorf("Resolve(entry0, de) = %+v, %v; want Data=200 (default fallback), nil", v, err)
+	}
+	if v, err := table.Resolve(entry1, de); err != nil || v.Data != 300 {
+		t.Errorf("Resolve(entry1, de) = %+v, %v; want Data=300 (first-entry fallback), nil", v, err)
+	}
+	if _, err := table.Resolve(0x01020000, de); err == nil {
+		t.Error("Resolve(unknown type) = nil error, want an error")
+	}
+	if _, err := table.Resolve(0x02010000, de); err == nil {
+		t.Error("Resolve(unknown package) = nil error, want an error")
+	}
+}
@@ -18,23 +18,19 @@ package apkdig
 
 import (
 	"encoding/binary"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
-	"unicode/utf16"
+	"math"
+
+	"github.com/joeleonjr/apkdig/arsc"
+	"github.com/joeleonjr/apkdig/axml"
 )
 
 const (
-	CHUNK_AXML_FILE           = 0x00080003
-	CHUNK_RESOURCEIDS         = 0x00080180
-	CHUNK_STRINGS             = 0x001C0001
-	CHUNK_XML_END_NAMESPACE   = 0x00100101
-	CHUNK_XML_END_TAG         = 0x00100103
-	CHUNK_XML_START_NAMESPACE = 0x00100100
-	CHUNK_XML_START_TAG       = 0x00100102
-	CHUNK_XML_TEXT            = 0x00100104
-	UTF8_FLAG                 = 0x00000100
-	SKIP_BLOCK                = 0xFFFFFFFF
+	CHUNK_AXML_FILE = 0x00080003
+	SKIP_BLOCK      = 0xFFFFFFFF
 )
 
 /*          AXML Data structure
@@ -69,122 +65,382 @@ type StringsMeta struct {
 	DataOffset       []uint32
 }
 
+// AXMLAttribute is a single attribute found on a CHUNK_XML_START_TAG node.
+// Namespace is the prefix the source document declared for this attribute's
+// URI (e.g. "android"), resolved against the CHUNK_XML_START_NAMESPACE
+// chunks in scope at the point the attribute was read. It is empty for
+// unqualified attributes.
+type AXMLAttribute struct {
+	Namespace string
+	Name      string
+	Value     AttrValue
+}
+
+// AttrValueType is the aValueType of a CHUNK_XML_START_TAG attribute tuple,
+// selecting how to interpret its aValue/valueString fields.
+type AttrValueType uint32
+
+const (
+	ATTR_TYPE_REFERENCE       AttrValueType = 0x01
+	ATTR_TYPE_STRING          AttrValueType = 0x03
+	ATTR_TYPE_FLOAT           AttrValueType = 0x04
+	ATTR_TYPE_INT_DEC         AttrValueType = 0x10
+	ATTR_TYPE_INT_HEX         AttrValueType = 0x11
+	ATTR_TYPE_INT_BOOLEAN     AttrValueType = 0x12
+	ATTR_TYPE_INT_COLOR_ARGB8 AttrValueType = 0x1C
+	ATTR_TYPE_INT_COLOR_RGB8  AttrValueType = 0x1D
+)
+
+// AttrValue is the decoded value of a single attribute. Which field is
+// meaningful is selected by Type; the others are zero.
+type AttrValue struct {
+	Type      AttrValueType
+	Str       string  // ATTR_TYPE_STRING
+	Reference uint32  // ATTR_TYPE_REFERENCE: a @id/... resource id
+	Int       int32   // ATTR_TYPE_INT_DEC, ATTR_TYPE_INT_HEX
+	Bool      bool    // ATTR_TYPE_INT_BOOLEAN
+	Float     float32 // ATTR_TYPE_FLOAT
+	Color     uint32  // ATTR_TYPE_INT_COLOR_ARGB8, ATTR_TYPE_INT_COLOR_RGB8
+}
+
+// String renders v the way aapt-alike tools print it in a plaintext manifest,
+// e.g. "1", "0x1", "true", "#FFFFFFFF" or "@0x7f010001".
+func (v AttrValue) String() string {
+	switch v.Type {
+	case ATTR_TYPE_STRING:
+		return v.Str
+	case ATTR_TYPE_REFERENCE:
+		return fmt.Sprintf("@0x%08x", v.Reference)
+	case ATTR_TYPE_INT_DEC:
+		return fmt.Sprintf("%d", v.Int)
+	case ATTR_TYPE_INT_HEX:
+		return fmt.Sprintf("0x%x", uint32(v.Int))
+	case ATTR_TYPE_INT_BOOLEAN:
+		return fmt.Sprintf("%t", v.Bool)
+	case ATTR_TYPE_FLOAT:
+		return fmt.Sprintf("%g", v.Float)
+	case ATTR_TYPE_INT_COLOR_ARGB8, ATTR_TYPE_INT_COLOR_RGB8:
+		return fmt.Sprintf("#%08X", v.Color)
+	default:
+		return fmt.Sprintf("0x%x", uint32(v.Int))
+	}
+}
+
+// decodeAttrValue interprets the raw valueString/aValue tuple of an
+// attribute according to its aValueType.
+func decodeAttrValue(t AttrValueType, valueString, value uint32, strings []string) (AttrValue, error) {
+	switch t {
+	case ATTR_TYPE_STRING:
+		str := ""
+		if valueString != SKIP_BLOCK {
+			var err error
+			if str, err = lookupString(strings, valueString); err != nil {
+				return AttrValue{}, err
+			}
+		}
+		return AttrValue{Type: t, Str: str}, nil
+	case ATTR_TYPE_REFERENCE:
+		return AttrValue{Type: t, Reference: value}, nil
+	case ATTR_TYPE_INT_DEC, ATTR_TYPE_INT_HEX:
+		return AttrValue{Type: t, Int: int32(value)}, nil
+	case ATTR_TYPE_INT_BOOLEAN:
+		return AttrValue{Type: t, Bool: value != 0}, nil
+	case ATTR_TYPE_FLOAT:
+		return AttrValue{Type: t, Float: math.Float32frombits(value)}, nil
+	case ATTR_TYPE_INT_COLOR_ARGB8, ATTR_TYPE_INT_COLOR_RGB8:
+		return AttrValue{Type: t, Color: value}, nil
+	default:
+		return AttrValue{Type: t, Int: int32(value)}, nil
+	}
+}
+
+// AXMLNode is one element of the parsed binary XML tree, rooted at AXML.Root.
+// It mirrors the structure encoded by the CHUNK_XML_* chunks: a
+// CHUNK_XML_START_TAG becomes a node, its nested CHUNK_XML_START_TAG children
+// become Children, its CHUNK_XML_TEXT children are collected into Text, and
+// the matching CHUNK_XML_END_TAG closes it.
+type AXMLNode struct {
+	Name       string
+	Namespace  string
+	Attributes []AXMLAttribute
+	Children   []*AXMLNode
+	LineNumber uint32
+	// Text holds character data captured by a CHUNK_XML_TEXT chunk that is
+	// a direct child of this node. It is empty for ordinary elements.
+	Text string
+
+	// xmlns holds the prefix->uri namespace declarations this node makes:
+	// the CHUNK_XML_START_NAMESPACE chunks read since the previous start tag
+	// that have not been closed. Declarations inherited from an ancestor are
+	// not repeated here. They are rendered as xmlns(:prefix) attributes by
+	// WriteXML.
+	xmlns map[string]string
+}
+
 type AXML struct {
 	Header      uint32
 	size        uint32
 	stringsmeta StringsMeta
 	Strings     []string
+	// ResourceIds holds the raw resource IDs from the file's
+	// CHUNK_RESOURCEIDS chunk, if present, one per string in Strings that
+	// names an attribute.
+	ResourceIds []uint32
+	// Root is the outermost element of the parsed document, or nil if the
+	// file contained no CHUNK_XML_START_TAG chunks.
+	Root *AXMLNode
+
+	// Resources, if set, is consulted by WriteXML to resolve
+	// ATTR_TYPE_REFERENCE attribute values (e.g. @string/app_name) against
+	// the default configuration. It is nil unless a caller sets it (see
+	// apk.APK.Resources), so parsing a manifest on its own still renders
+	// references as "@0x...".
+	Resources *arsc.ARSC
+}
+
+// lookupString returns strings[idx], or an error if idx is out of range.
+// Every CHUNK_XML_* field that names a string-pool entry is attacker
+// controlled, so this must be used instead of a bare index wherever one is
+// dereferenced.
+func lookupString(strings []string, idx uint32) (string, error) {
+	if int(idx) >= len(strings) {
+		return "", fmt.Errorf("axml: string index %d out of range (pool has %d strings)", idx, len(strings))
+	}
+	return strings[idx], nil
 }
 
+// ReadAXML parses a binary AndroidManifest.xml. Each chunk's raw fields are
+// decoded by the axml.Chunk the chunk's type is registered under (see
+// axml.RegisterChunk); this loop only assembles the decoded chunks into the
+// AXMLNode tree, tracking the handful of things that span chunks (the
+// string pool, the namespace scope, and the currently-open element stack).
 func ReadAXML(reader io.ReadSeeker) (AXML, error) {
-	axml := AXML{}
-	binary.Read(reader, binary.LittleEndian, &axml.Header)
-	if axml.Header != CHUNK_AXML_FILE {
-		return axml, errors.New("AXML file has wrong header")
+	axmlFile := AXML{}
+	binary.Read(reader, binary.LittleEndian, &axmlFile.Header)
+	if axmlFile.Header != CHUNK_AXML_FILE {
+		return axmlFile, errors.New("AXML file has wrong header")
 	}
-	binary.Read(reader, binary.LittleEndian, &axml.size)
-	var blocktype, size uint32
+	binary.Read(reader, binary.LittleEndian, &axmlFile.size)
+
+	// namespaces tracks prefix->uri for CHUNK_XML_START_NAMESPACE chunks that
+	// are in scope but not yet attached to the element that declares them.
+	namespaces := map[string]string{}
+	// nsScope is a stack of the prefix/uri pairs currently in scope, used to
+	// turn the URIs that nsIdx/aNsIdx point at back into the prefix the
+	// source document used.
+	var nsScope []struct{ prefix, uri string }
+	var stack []*AXMLNode
 	// Start offset at 8 bytes for header and size
-	for offset := uint32(8); offset < axml.size; {
+	for offset := uint32(8); offset < axmlFile.size; {
+		var blocktype, size uint32
 		binary.Read(reader, binary.LittleEndian, &blocktype)
 		binary.Read(reader, binary.LittleEndian, &size)
-		switch blocktype {
-		default:
-			return axml, fmt.Errorf("Unkown chunk type: %X", blocktype)
-		case CHUNK_RESOURCEIDS:
-			fmt.Printf("@%04X[%04X]:\tCHUNK_RESOURCEIDS\n", offset, size)
-		case CHUNK_STRINGS:
-			/* +------------------------------------+
-			 * | Nstrings         uint32            |
-			 * | StyleOffsetCount uint32            |
-			 * | Flags            uint32            |
-			 * | StringDataOffset uint32            |
-			 * | flag             uint32            |
-			 * | Stylesoffset     uint32            |
-			 * +------------------------------------+
-			 * | +--------------------------------+ |
-			 * | | DataOffset uint32              | |
-			 * | +--------------------------------+ |
-			 * |       Repeat Nstrings times        |
-			 * +------------------------------------+
-			 * |
-			 * +------------------------------------+
-			 */
-			binary.Read(reader, binary.LittleEndian, &axml.stringsmeta.Nstrings)
-			binary.Read(reader, binary.LittleEndian, &axml.stringsmeta.StyleOffsetCount)
-			binary.Read(reader, binary.LittleEndian, &axml.stringsmeta.Flags)
-			binary.Read(reader, binary.LittleEndian, &axml.stringsmeta.StringDataOffset)
-			binary.Read(reader, binary.LittleEndian, &axml.stringsmeta.Stylesoffset)
-			for i := uint32(0); i < axml.stringsmeta.Nstrings; i++ {
-				var offset uint32
-				binary.Read(reader, binary.LittleEndian, &offset)
-				axml.stringsmeta.DataOffset = append(axml.stringsmeta.DataOffset, offset)
+
+		chunk := axml.NewChunk(blocktype)
+		if chunk == nil {
+			return axmlFile, fmt.Errorf("Unkown chunk type: %X", blocktype)
+		}
+		if size < 8 {
+			return axmlFile, fmt.Errorf("chunk %X declares size %d, smaller than its own 8-byte header", blocktype, size)
+		}
+		data := make([]byte, size)
+		binary.LittleEndian.PutUint32(data[0:4], blocktype)
+		binary.LittleEndian.PutUint32(data[4:8], size)
+		if _, err := io.ReadFull(reader, data[8:]); err != nil {
+			return axmlFile, err
+		}
+		if err := chunk.UnmarshalBinary(data); err != nil {
+			return axmlFile, err
+		}
+
+		switch b := chunk.(type) {
+		case *axml.ResourceIdsBlock:
+			axmlFile.ResourceIds = b.Ids
+		case *axml.StringPoolBlock:
+			axmlFile.Strings = b.Strings
+			axmlFile.stringsmeta = StringsMeta{
+				Nstrings:         b.Nstrings,
+				StyleOffsetCount: b.StyleOffsetCount,
+				Flags:            b.Flags,
+				StringDataOffset: b.StringDataOffset,
+				Stylesoffset:     b.Stylesoffset,
+				DataOffset:       b.DataOffset,
+			}
+		case *axml.StartNamespaceBlock:
+			prefix, err := lookupString(axmlFile.Strings, b.PrefixIdx)
+			if err != nil {
+				return axmlFile, err
+			}
+			uri, err := lookupString(axmlFile.Strings, b.UriIdx)
+			if err != nil {
+				return axmlFile, err
+			}
+			namespaces[prefix] = uri
+			nsScope = append(nsScope, struct{ prefix, uri string }{prefix, uri})
+		case *axml.EndNamespaceBlock:
+			prefix, err := lookupString(axmlFile.Strings, b.PrefixIdx)
+			if err != nil {
+				return axmlFile, err
+			}
+			uri, err := lookupString(axmlFile.Strings, b.UriIdx)
+			if err != nil {
+				return axmlFile, err
+			}
+			delete(namespaces, prefix)
+			for i := len(nsScope) - 1; i >= 0; i-- {
+				if nsScope[i].prefix == prefix && nsScope[i].uri == uri {
+					nsScope = append(nsScope[:i], nsScope[i+1:]...)
+					break
+				}
 			}
-			if 0 != (axml.stringsmeta.Flags & UTF8_FLAG) {
-				// String will be in UTF-8 encoding
-				var s string
-				binary.Read(reader, binary.LittleEndian, &s)
-			} else {
-				// String will be in UTF-16LE encoding
-				for i := uint32(0); i < axml.stringsmeta.Nstrings; i++ {
-					var size uint16
-					binary.Read(reader, binary.LittleEndian, &size)
-					stringbytes := make([]uint16, size)
-					binary.Read(reader, binary.LittleEndian, &stringbytes)
-					axml.Strings = append(axml.Strings, string(utf16.Decode(stringbytes)))
-					if i != axml.stringsmeta.Nstrings-1 {
-						reader.Seek(2, 1)
+		case *axml.StartTagBlock:
+			name, err := lookupString(axmlFile.Strings, b.NameIdx)
+			if err != nil {
+				return axmlFile, err
+			}
+			node := &AXMLNode{
+				Name:       name,
+				LineNumber: b.LineNumber,
+			}
+			if b.NsIdx != SKIP_BLOCK {
+				uri, err := lookupString(axmlFile.Strings, b.NsIdx)
+				if err != nil {
+					return axmlFile, err
+				}
+				node.Namespace = resolvePrefix(nsScope, uri)
+			}
+			for _, a := range b.Attributes {
+				attrName, err := lookupString(axmlFile.Strings, a.NameIdx)
+				if err != nil {
+					return axmlFile, err
+				}
+				value, err := decodeAttrValue(AttrValueType(a.AValueType), a.ValueString, a.AValue, axmlFile.Strings)
+				if err != nil {
+					return axmlFile, err
+				}
+				attr := AXMLAttribute{Name: attrName, Value: value}
+				if a.NsIdx != SKIP_BLOCK {
+					uri, err := lookupString(axmlFile.Strings, a.NsIdx)
+					if err != nil {
+						return axmlFile, err
 					}
+					attr.Namespace = resolvePrefix(nsScope, uri)
+				}
+				node.Attributes = append(node.Attributes, attr)
+			}
+			if len(namespaces) > 0 {
+				node.xmlns = make(map[string]string, len(namespaces))
+				for prefix, uri := range namespaces {
+					node.xmlns[prefix] = uri
 				}
+				namespaces = map[string]string{}
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			} else if axmlFile.Root == nil {
+				axmlFile.Root = node
 			}
-		case CHUNK_XML_END_NAMESPACE:
-			fmt.Printf("@%04X[%04X]:\tCHUNK_XML_END_NAMESPACE\n", offset, size)
-		case CHUNK_XML_END_TAG:
-			fmt.Printf("@%04X[%04X]:\tCHUNK_XML_END_TAG\n", offset, size)
-		case CHUNK_XML_START_NAMESPACE:
-			fmt.Printf("@%04X[%04X]:\tCHUNK_XML_START_NAMESPACE\n", offset, size)
-		case CHUNK_XML_START_TAG:
-			/* +------------------------------------+
-			 * | lineNumber     uint32              |
-			 * | skip           uint32 = SKIP_BLOCK |
-			 * | nsIdx          uint32              |
-			 * | nameIdx        uint32              |
-			 * | flag           uint32 = 0x00140014 |
-			 * | attributeCount uint16              |
-			 * +------------------------------------+
-			 * | +--------------------------------+ |
-			 * | | nsIdx       uint32             | |
-			 * | | nameIdx     uint32             | |
-			 * | | valueString uint32 // Skipped  | |
-			 * | | aValueType  uint32             | |
-			 * | | aValue      uint32             | |
-			 * | +--------------------------------+ |
-			 * |   Repeat attributeCount times      |
-			 * +------------------------------------+
-			 */
-
-			var lineNumber, skip, nsIdx, nameIdx, flag uint32
-			var attributeCount uint
-			binary.Read(reader, binary.LittleEndian, &lineNumber)
-			binary.Read(reader, binary.LittleEndian, &skip)
-			if skip != SKIP_BLOCK {
-				return axml, errors.New("Error: Expected block 0xFFFFFFFF")
+			stack = append(stack, node)
+		case *axml.EndTagBlock:
+			if len(stack) == 0 {
+				name, err := lookupString(axmlFile.Strings, b.NameIdx)
+				if err != nil {
+					return axmlFile, err
+				}
+				return axmlFile, fmt.Errorf("CHUNK_XML_END_TAG for %q with no open tag", name)
 			}
-			binary.Read(reader, binary.LittleEndian, &nsIdx)
-			binary.Read(reader, binary.LittleEndian, &nameIdx)
-			binary.Read(reader, binary.LittleEndian, &flag)
-			// Check if flag is magick number
-			// https://code.google.com/p/axml/source/browse/src/main/java/pxb/android/axml/AxmlReader.java?r=9bc9e64ef832736a93750998a9fa1d4406b858c3#102
-			if flag != 0x00140014 {
-				return axml, fmt.Errorf("Expected flag 0x00140014, found %08X at %08X\n", flag, offset+4*6)
+			stack = stack[:len(stack)-1]
+		case *axml.TextBlock:
+			if len(stack) > 0 {
+				text, err := lookupString(axmlFile.Strings, b.TextIdx)
+				if err != nil {
+					return axmlFile, err
+				}
+				stack[len(stack)-1].Text += text
 			}
-			binary.Read(reader, binary.LittleEndian, &attributeCount)
-			fmt.Printf("Line %d\t<%s>\n", lineNumber, axml.Strings[nameIdx])
-		case CHUNK_XML_TEXT:
-			fmt.Printf("@%04X[%04X]:\tCHUNK_XML_TEXT\n", offset, size)
 		}
 		offset += size
 		reader.Seek(int64(offset), 0)
 	}
-	return axml, nil
+	return axmlFile, nil
+}
+
+// WriteXML renders the parsed document tree as the plaintext AndroidManifest.xml
+// an APK would have shipped with source-side, using encoding/xml to handle
+// escaping and indentation. Since encoding/xml has no notion of namespace
+// prefixes, qualified names are emitted as literal "prefix:local" Local names
+// (the same workaround aapt-alike tools use) so prefixes round-trip exactly.
+func (a *AXML) WriteXML(w io.Writer) error {
+	if a.Root == nil {
+		return errors.New("AXML has no root element")
+	}
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "    ")
+	if err := a.writeXMLNode(enc, a.Root); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func (a *AXML) writeXMLNode(enc *xml.Encoder, node *AXMLNode) error {
+	start := xml.StartElement{Name: xml.Name{Local: qualifiedName(node.Namespace, node.Name)}}
+	for prefix, uri := range node.xmlns {
+		attrName := "xmlns"
+		if prefix != "" {
+			attrName = "xmlns:" + prefix
+		}
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attrName}, Value: uri})
+	}
+	for _, attr := range node.Attributes {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: qualifiedName(attr.Namespace, attr.Name)}, Value: a.renderAttrValue(attr.Value)})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if node.Text != "" {
+		if err := enc.EncodeToken(xml.CharData(node.Text)); err != nil {
+			return err
+		}
+	}
+	for _, child := range node.Children {
+		if err := a.writeXMLNode(enc, child); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// renderAttrValue is the text WriteXML emits for v. A reference is resolved
+// against a.Resources (if set) for the default configuration, the same way
+// aapt's "@string/app_name" shows up as "MyApp" in a decoded manifest;
+// anything that can't be resolved falls back to v.String()'s "@0x..." form.
+func (a *AXML) renderAttrValue(v AttrValue) string {
+	if v.Type == ATTR_TYPE_REFERENCE && a.Resources != nil {
+		if resolved, err := a.Resources.Resolve(v.Reference, arsc.DefaultConfig); err == nil && resolved.Type == arsc.TypeString {
+			return resolved.Str
+		}
+	}
+	return v.String()
+}
+
+// qualifiedName returns "prefix:name", or name unchanged if prefix is empty.
+func qualifiedName(prefix, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + ":" + name
+}
+
+// resolvePrefix looks up the prefix declared for uri among the
+// CHUNK_XML_START_NAMESPACE chunks currently in scope, innermost first. It
+// returns "" if uri is not currently bound to a prefix.
+func resolvePrefix(scope []struct{ prefix, uri string }, uri string) string {
+	for i := len(scope) - 1; i >= 0; i-- {
+		if scope[i].uri == uri {
+			return scope[i].prefix
+		}
+	}
+	return ""
 }
@@ -0,0 +1,81 @@
+package axml
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+// Chunk type identifiers. CHUNK_AXML_FILE and SKIP_BLOCK are also defined in
+// the top-level apkdig package, which imports this one.
+const (
+	CHUNK_AXML_FILE           = 0x00080003
+	CHUNK_RESOURCEIDS         = 0x00080180
+	CHUNK_STRINGS             = 0x001C0001
+	CHUNK_XML_END_NAMESPACE   = 0x00100101
+	CHUNK_XML_END_TAG         = 0x00100103
+	CHUNK_XML_START_NAMESPACE = 0x00100100
+	CHUNK_XML_START_TAG       = 0x00100102
+	CHUNK_XML_TEXT            = 0x00100104
+	UTF8_FLAG                 = 0x00000100
+	SKIP_BLOCK                = 0xFFFFFFFF
+
+	// ATTRIBUTE_FLAG is the magic value Android always writes for the
+	// "flag" field of a CHUNK_XML_START_TAG chunk.
+	ATTRIBUTE_FLAG = 0x00140014
+)
+
+// AxmlBlock holds the chunk header fields ("Type" and "Size") that every
+// chunk in a binary AXML file shares, plus a byte offset. Offset is set by
+// ReadResourceIdsBlock; UnmarshalBinary and ReadAXML leave it zero.
+// Chunk-specific block types embed it.
+type AxmlBlock struct {
+	Type   uint32
+	Size   uint32
+	Offset int64
+}
+
+func (b AxmlBlock) Kind() uint32 {
+	return b.Type
+}
+
+// Chunk is implemented by every chunk type this package knows how to decode.
+// UnmarshalBinary receives the chunk's full bytes, including its own 8-byte
+// type+size header (the same form MarshalBinary produces), so it can
+// validate its own type the way every existing block already does.
+type Chunk interface {
+	UnmarshalBinary(data []byte) error
+	Kind() uint32
+}
+
+// registry maps a chunk type id to a constructor for the Go type that
+// decodes it, populated by each chunk file's init.
+var registry = map[uint32]func() Chunk{}
+
+// RegisterChunk associates a chunk type id with factory, a constructor for
+// the Chunk that decodes it. Chunk files call this from their own init so a
+// new chunk type (XML_CDATA, a vendor chunk, ...) can be taught to
+// ReadAXML by adding a file here, without touching ReadAXML itself.
+func RegisterChunk(id uint32, factory func() Chunk) {
+	registry[id] = factory
+}
+
+// NewChunk returns a fresh, zero-valued Chunk for id ready to have
+// UnmarshalBinary called on it, or nil if no factory is registered for id.
+func NewChunk(id uint32) Chunk {
+	factory, ok := registry[id]
+	if !ok {
+		return nil
+	}
+	return factory()
+}
@@ -0,0 +1,102 @@
+package axml
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+func init() {
+	RegisterChunk(CHUNK_XML_START_NAMESPACE, func() Chunk { return &StartNamespaceBlock{} })
+	RegisterChunk(CHUNK_XML_END_NAMESPACE, func() Chunk { return &EndNamespaceBlock{} })
+}
+
+/* +------------------------------------+
+ * | lineNumber uint32                  |
+ * | skip       uint32 = SKIP_BLOCK     |
+ * | prefixIdx  uint32                  |
+ * | uriIdx     uint32                  |
+ * +------------------------------------+
+ */
+type StartNamespaceBlock struct {
+	AxmlBlock
+	LineNumber uint32
+	PrefixIdx  uint32
+	UriIdx     uint32
+}
+
+func (b *StartNamespaceBlock) UnmarshalBinary(data []byte) error {
+	return unmarshalNamespaceBlock(data, CHUNK_XML_START_NAMESPACE, &b.AxmlBlock, &b.LineNumber, &b.PrefixIdx, &b.UriIdx)
+}
+
+func (b StartNamespaceBlock) MarshalBinary() ([]byte, error) {
+	b.Type = CHUNK_XML_START_NAMESPACE
+	return marshalNamespaceBlock(b.AxmlBlock, b.LineNumber, b.PrefixIdx, b.UriIdx)
+}
+
+// EndNamespaceBlock closes the scope opened by a matching StartNamespaceBlock.
+type EndNamespaceBlock struct {
+	AxmlBlock
+	LineNumber uint32
+	PrefixIdx  uint32
+	UriIdx     uint32
+}
+
+func (b *EndNamespaceBlock) UnmarshalBinary(data []byte) error {
+	return unmarshalNamespaceBlock(data, CHUNK_XML_END_NAMESPACE, &b.AxmlBlock, &b.LineNumber, &b.PrefixIdx, &b.UriIdx)
+}
+
+func (b EndNamespaceBlock) MarshalBinary() ([]byte, error) {
+	b.Type = CHUNK_XML_END_NAMESPACE
+	return marshalNamespaceBlock(b.AxmlBlock, b.LineNumber, b.PrefixIdx, b.UriIdx)
+}
+
+func unmarshalNamespaceBlock(data []byte, want uint32, b *AxmlBlock, lineNumber, prefixIdx, uriIdx *uint32) error {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &b.Type); err != nil {
+		return err
+	}
+	if b.Type != want {
+		return fmt.Errorf("Expected type=%X, got type=%X", want, b.Type)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &b.Size); err != nil {
+		return err
+	}
+	var skip uint32
+	binary.Read(reader, binary.LittleEndian, lineNumber)
+	binary.Read(reader, binary.LittleEndian, &skip)
+	if skip != SKIP_BLOCK {
+		return fmt.Errorf("Error: Expected block 0xFFFFFFFF, got %08X", skip)
+	}
+	binary.Read(reader, binary.LittleEndian, prefixIdx)
+	binary.Read(reader, binary.LittleEndian, uriIdx)
+	return nil
+}
+
+func marshalNamespaceBlock(b AxmlBlock, lineNumber, prefixIdx, uriIdx uint32) ([]byte, error) {
+	b.Size = 4 * 6
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, &b.Type)
+	binary.Write(buf, binary.LittleEndian, &b.Size)
+	binary.Write(buf, binary.LittleEndian, &lineNumber)
+	binary.Write(buf, binary.LittleEndian, uint32(SKIP_BLOCK))
+	binary.Write(buf, binary.LittleEndian, &prefixIdx)
+	binary.Write(buf, binary.LittleEndian, &uriIdx)
+	return buf.Bytes(), nil
+}
@@ -76,6 +76,10 @@ func (b ResourceIdsBlock) MarshalBinary() (data []byte, err error) {
 	return buf.Bytes(), nil
 }
 
+func init() {
+	RegisterChunk(CHUNK_RESOURCEIDS, func() Chunk { return &ResourceIdsBlock{} })
+}
+
 func ReadResourceIdsBlock(reader io.ReadSeeker, size uint32, offset int64) (rid ResourceIdsBlock, err error) {
 	rid.Type = CHUNK_RESOURCEIDS
 	rid.Size = size
@@ -0,0 +1,200 @@
+package axml
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"unicode/utf16"
+)
+
+/* +------------------------------------+
+ * | Nstrings         uint32            |
+ * | StyleOffsetCount uint32            |
+ * | Flags            uint32            |
+ * | StringDataOffset uint32            |
+ * | Stylesoffset     uint32            |
+ * +------------------------------------+
+ * | +--------------------------------+ |
+ * | | DataOffset uint32              | |
+ * | +--------------------------------+ |
+ * |       Repeat Nstrings times        |
+ * +------------------------------------+
+ * |           string data              |
+ * +------------------------------------+
+ */
+func init() {
+	RegisterChunk(CHUNK_STRINGS, func() Chunk { return &StringPoolBlock{} })
+}
+
+type StringPoolBlock struct {
+	AxmlBlock
+	Nstrings         uint32
+	StyleOffsetCount uint32
+	Flags            uint32
+	StringDataOffset uint32
+	Stylesoffset     uint32
+	DataOffset       []uint32
+	Strings          []string
+}
+
+func (b *StringPoolBlock) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &b.Type); err != nil {
+		return err
+	}
+	if b.Type != CHUNK_STRINGS {
+		return fmt.Errorf("Expected type=%X, got type=%X", CHUNK_STRINGS, b.Type)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &b.Size); err != nil {
+		return err
+	}
+	binary.Read(reader, binary.LittleEndian, &b.Nstrings)
+	binary.Read(reader, binary.LittleEndian, &b.StyleOffsetCount)
+	binary.Read(reader, binary.LittleEndian, &b.Flags)
+	binary.Read(reader, binary.LittleEndian, &b.StringDataOffset)
+	binary.Read(reader, binary.LittleEndian, &b.Stylesoffset)
+	b.DataOffset = nil
+	for i := uint32(0); i < b.Nstrings; i++ {
+		var offset uint32
+		binary.Read(reader, binary.LittleEndian, &offset)
+		b.DataOffset = append(b.DataOffset, offset)
+	}
+	b.Strings = nil
+	for _, dataOffset := range b.DataOffset {
+		if _, err := reader.Seek(int64(b.StringDataOffset)+int64(dataOffset), io.SeekStart); err != nil {
+			return err
+		}
+		if 0 != (b.Flags & UTF8_FLAG) {
+			// UTF-8: character length then byte length, both encoded as one
+			// or two bytes with the high bit as a continuation marker,
+			// followed by the payload and a single NUL terminator.
+			if _, err := readUTF8Length(reader); err != nil {
+				return err
+			}
+			n, err := readUTF8Length(reader)
+			if err != nil {
+				return err
+			}
+			strbytes := make([]byte, n)
+			if _, err := io.ReadFull(reader, strbytes); err != nil {
+				return err
+			}
+			b.Strings = append(b.Strings, string(strbytes))
+		} else {
+			// UTF-16LE: length in UTF-16 code units, encoded as one or two
+			// uint16s with the high bit as a continuation marker, followed
+			// by the payload and a NUL terminator.
+			n, err := readUTF16Length(reader)
+			if err != nil {
+				return err
+			}
+			stringbytes := make([]uint16, n)
+			if err := binary.Read(reader, binary.LittleEndian, &stringbytes); err != nil {
+				return err
+			}
+			b.Strings = append(b.Strings, string(utf16.Decode(stringbytes)))
+		}
+	}
+	return nil
+}
+
+// readUTF16Length reads a string-pool entry's length as one or two uint16s:
+// if the high bit of the first one is set, it and the following uint16
+// together encode a 31-bit length; otherwise the first uint16 is the length.
+func readUTF16Length(r io.Reader) (uint32, error) {
+	var lo uint16
+	if err := binary.Read(r, binary.LittleEndian, &lo); err != nil {
+		return 0, err
+	}
+	if lo&0x8000 == 0 {
+		return uint32(lo), nil
+	}
+	var hi uint16
+	if err := binary.Read(r, binary.LittleEndian, &hi); err != nil {
+		return 0, err
+	}
+	return uint32(lo&0x7FFF)<<16 | uint32(hi), nil
+}
+
+// readUTF8Length reads a string-pool entry's length as one or two bytes: if
+// the high bit of the first one is set, it and the following byte together
+// encode a 15-bit length; otherwise the first byte is the length.
+func readUTF8Length(r io.Reader) (uint32, error) {
+	var lo uint8
+	if err := binary.Read(r, binary.LittleEndian, &lo); err != nil {
+		return 0, err
+	}
+	if lo&0x80 == 0 {
+		return uint32(lo), nil
+	}
+	var hi uint8
+	if err := binary.Read(r, binary.LittleEndian, &hi); err != nil {
+		return 0, err
+	}
+	return uint32(lo&0x7F)<<8 | uint32(hi), nil
+}
+
+func (b *StringPoolBlock) MarshalBinary() (data []byte, err error) {
+	var stringdata bytes.Buffer
+	dataOffset := make([]uint32, len(b.Strings))
+	for i, s := range b.Strings {
+		dataOffset[i] = uint32(stringdata.Len())
+		units := utf16.Encode([]rune(s))
+		binary.Write(&stringdata, binary.LittleEndian, uint16(len(units)))
+		binary.Write(&stringdata, binary.LittleEndian, units)
+		binary.Write(&stringdata, binary.LittleEndian, uint16(0))
+	}
+	b.Nstrings = uint32(len(b.Strings))
+	b.StyleOffsetCount = 0
+	b.Flags = 0
+	b.StringDataOffset = 7*4 + b.Nstrings*4
+	b.Stylesoffset = 0
+	b.DataOffset = dataOffset
+	b.Type = CHUNK_STRINGS
+	b.Size = b.StringDataOffset + uint32(stringdata.Len())
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, &b.Type)
+	binary.Write(buf, binary.LittleEndian, &b.Size)
+	binary.Write(buf, binary.LittleEndian, &b.Nstrings)
+	binary.Write(buf, binary.LittleEndian, &b.StyleOffsetCount)
+	binary.Write(buf, binary.LittleEndian, &b.Flags)
+	binary.Write(buf, binary.LittleEndian, &b.StringDataOffset)
+	binary.Write(buf, binary.LittleEndian, &b.Stylesoffset)
+	for _, offset := range b.DataOffset {
+		binary.Write(buf, binary.LittleEndian, offset)
+	}
+	buf.Write(stringdata.Bytes())
+	return buf.Bytes(), nil
+}
+
+// InternString returns the index of s in the pool, appending it if it is not
+// already present. Callers patching a manifest (adding a permission, an
+// activity name, ...) use this to obtain a string index for a new
+// StartTagBlock/Attribute before marshalling.
+func (b *StringPoolBlock) InternString(s string) uint32 {
+	for i, existing := range b.Strings {
+		if existing == s {
+			return uint32(i)
+		}
+	}
+	b.Strings = append(b.Strings, s)
+	return uint32(len(b.Strings) - 1)
+}
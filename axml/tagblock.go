@@ -0,0 +1,185 @@
+package axml
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+func init() {
+	RegisterChunk(CHUNK_XML_START_TAG, func() Chunk { return &StartTagBlock{} })
+	RegisterChunk(CHUNK_XML_END_TAG, func() Chunk { return &EndTagBlock{} })
+}
+
+// Attribute is one nsIdx/nameIdx/valueString/aValueType/aValue tuple of a
+// CHUNK_XML_START_TAG chunk.
+type Attribute struct {
+	NsIdx       uint32
+	NameIdx     uint32
+	ValueString uint32
+	AValueType  uint32
+	AValue      uint32
+}
+
+/* +------------------------------------+
+ * | lineNumber     uint32              |
+ * | skip           uint32 = SKIP_BLOCK |
+ * | nsIdx          uint32              |
+ * | nameIdx        uint32              |
+ * | flag           uint32 = ATTRIBUTE_FLAG |
+ * | attributeCount uint16              |
+ * | idIndex        uint16              |
+ * | classIndex     uint16              |
+ * | styleIndex     uint16              |
+ * +------------------------------------+
+ * | +--------------------------------+ |
+ * | | nsIdx       uint32             | |
+ * | | nameIdx     uint32             | |
+ * | | valueString uint32             | |
+ * | | aValueType  uint32             | |
+ * | | aValue      uint32             | |
+ * | +--------------------------------+ |
+ * |   Repeat attributeCount times      |
+ * +------------------------------------+
+ */
+type StartTagBlock struct {
+	AxmlBlock
+	LineNumber uint32
+	NsIdx      uint32
+	NameIdx    uint32
+	IdIndex    uint16
+	ClassIndex uint16
+	StyleIndex uint16
+	Attributes []Attribute
+}
+
+func (b *StartTagBlock) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &b.Type); err != nil {
+		return err
+	}
+	if b.Type != CHUNK_XML_START_TAG {
+		return fmt.Errorf("Expected type=%X, got type=%X", CHUNK_XML_START_TAG, b.Type)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &b.Size); err != nil {
+		return err
+	}
+	var skip, flag uint32
+	var attributeCount uint16
+	binary.Read(reader, binary.LittleEndian, &b.LineNumber)
+	binary.Read(reader, binary.LittleEndian, &skip)
+	if skip != SKIP_BLOCK {
+		return fmt.Errorf("Error: Expected block 0xFFFFFFFF, got %08X", skip)
+	}
+	binary.Read(reader, binary.LittleEndian, &b.NsIdx)
+	binary.Read(reader, binary.LittleEndian, &b.NameIdx)
+	binary.Read(reader, binary.LittleEndian, &flag)
+	if flag != ATTRIBUTE_FLAG {
+		return fmt.Errorf("Expected flag %08X, found %08X", ATTRIBUTE_FLAG, flag)
+	}
+	binary.Read(reader, binary.LittleEndian, &attributeCount)
+	binary.Read(reader, binary.LittleEndian, &b.IdIndex)
+	binary.Read(reader, binary.LittleEndian, &b.ClassIndex)
+	binary.Read(reader, binary.LittleEndian, &b.StyleIndex)
+	b.Attributes = nil
+	for i := uint16(0); i < attributeCount; i++ {
+		var attr Attribute
+		binary.Read(reader, binary.LittleEndian, &attr.NsIdx)
+		binary.Read(reader, binary.LittleEndian, &attr.NameIdx)
+		binary.Read(reader, binary.LittleEndian, &attr.ValueString)
+		binary.Read(reader, binary.LittleEndian, &attr.AValueType)
+		binary.Read(reader, binary.LittleEndian, &attr.AValue)
+		b.Attributes = append(b.Attributes, attr)
+	}
+	return nil
+}
+
+func (b StartTagBlock) MarshalBinary() ([]byte, error) {
+	b.Type = CHUNK_XML_START_TAG
+	b.Size = uint32(4*7+2*4) + uint32(20*len(b.Attributes))
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, &b.Type)
+	binary.Write(buf, binary.LittleEndian, &b.Size)
+	binary.Write(buf, binary.LittleEndian, &b.LineNumber)
+	binary.Write(buf, binary.LittleEndian, uint32(SKIP_BLOCK))
+	binary.Write(buf, binary.LittleEndian, &b.NsIdx)
+	binary.Write(buf, binary.LittleEndian, &b.NameIdx)
+	binary.Write(buf, binary.LittleEndian, uint32(ATTRIBUTE_FLAG))
+	binary.Write(buf, binary.LittleEndian, uint16(len(b.Attributes)))
+	binary.Write(buf, binary.LittleEndian, &b.IdIndex)
+	binary.Write(buf, binary.LittleEndian, &b.ClassIndex)
+	binary.Write(buf, binary.LittleEndian, &b.StyleIndex)
+	for _, attr := range b.Attributes {
+		binary.Write(buf, binary.LittleEndian, &attr.NsIdx)
+		binary.Write(buf, binary.LittleEndian, &attr.NameIdx)
+		binary.Write(buf, binary.LittleEndian, &attr.ValueString)
+		binary.Write(buf, binary.LittleEndian, &attr.AValueType)
+		binary.Write(buf, binary.LittleEndian, &attr.AValue)
+	}
+	return buf.Bytes(), nil
+}
+
+/* +------------------------------------+
+ * | lineNumber uint32                  |
+ * | skip       uint32 = SKIP_BLOCK     |
+ * | nsIdx      uint32                  |
+ * | nameIdx    uint32                  |
+ * +------------------------------------+
+ */
+type EndTagBlock struct {
+	AxmlBlock
+	LineNumber uint32
+	NsIdx      uint32
+	NameIdx    uint32
+}
+
+func (b *EndTagBlock) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &b.Type); err != nil {
+		return err
+	}
+	if b.Type != CHUNK_XML_END_TAG {
+		return fmt.Errorf("Expected type=%X, got type=%X", CHUNK_XML_END_TAG, b.Type)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &b.Size); err != nil {
+		return err
+	}
+	var skip uint32
+	binary.Read(reader, binary.LittleEndian, &b.LineNumber)
+	binary.Read(reader, binary.LittleEndian, &skip)
+	if skip != SKIP_BLOCK {
+		return fmt.Errorf("Error: Expected block 0xFFFFFFFF, got %08X", skip)
+	}
+	binary.Read(reader, binary.LittleEndian, &b.NsIdx)
+	binary.Read(reader, binary.LittleEndian, &b.NameIdx)
+	return nil
+}
+
+func (b EndTagBlock) MarshalBinary() ([]byte, error) {
+	b.Type = CHUNK_XML_END_TAG
+	b.Size = 4 * 6
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, &b.Type)
+	binary.Write(buf, binary.LittleEndian, &b.Size)
+	binary.Write(buf, binary.LittleEndian, &b.LineNumber)
+	binary.Write(buf, binary.LittleEndian, uint32(SKIP_BLOCK))
+	binary.Write(buf, binary.LittleEndian, &b.NsIdx)
+	binary.Write(buf, binary.LittleEndian, &b.NameIdx)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,76 @@
+package axml
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+func init() {
+	RegisterChunk(CHUNK_XML_TEXT, func() Chunk { return &TextBlock{} })
+}
+
+/* +------------------------------------+
+ * | lineNumber uint32                  |
+ * | skip       uint32 = SKIP_BLOCK     |
+ * | textIdx    uint32                  |
+ * | resValue   [8]byte // Skipped      |
+ * +------------------------------------+
+ */
+type TextBlock struct {
+	AxmlBlock
+	LineNumber uint32
+	TextIdx    uint32
+	ResValue   [8]byte
+}
+
+func (b *TextBlock) UnmarshalBinary(data []byte) error {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &b.Type); err != nil {
+		return err
+	}
+	if b.Type != CHUNK_XML_TEXT {
+		return fmt.Errorf("Expected type=%X, got type=%X", CHUNK_XML_TEXT, b.Type)
+	}
+	if err := binary.Read(reader, binary.LittleEndian, &b.Size); err != nil {
+		return err
+	}
+	var skip uint32
+	binary.Read(reader, binary.LittleEndian, &b.LineNumber)
+	binary.Read(reader, binary.LittleEndian, &skip)
+	if skip != SKIP_BLOCK {
+		return fmt.Errorf("Error: Expected block 0xFFFFFFFF, got %08X", skip)
+	}
+	binary.Read(reader, binary.LittleEndian, &b.TextIdx)
+	binary.Read(reader, binary.LittleEndian, &b.ResValue)
+	return nil
+}
+
+func (b TextBlock) MarshalBinary() ([]byte, error) {
+	b.Type = CHUNK_XML_TEXT
+	b.Size = 4*5 + uint32(len(b.ResValue))
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.LittleEndian, &b.Type)
+	binary.Write(buf, binary.LittleEndian, &b.Size)
+	binary.Write(buf, binary.LittleEndian, &b.LineNumber)
+	binary.Write(buf, binary.LittleEndian, uint32(SKIP_BLOCK))
+	binary.Write(buf, binary.LittleEndian, &b.TextIdx)
+	binary.Write(buf, binary.LittleEndian, &b.ResValue)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,123 @@
+package apkdig
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/joeleonjr/apkdig/axml"
+)
+
+// TestAXMLRoundTrip builds a tree with a multi-attribute element, marshals it
+// to binary and re-parses it, checking that every attribute tuple comes back
+// unshifted. A StartTagBlock that reads its attribute header short (as this
+// package once did) decodes later attributes' fields from the wrong offset,
+// so this catches that class of bug even with a single attribute.
+func TestAXMLRoundTrip(t *testing.T) {
+	root := &AXMLNode{
+		Name: "manifest",
+		Attributes: []AXMLAttribute{
+			{Name: "package", Value: AttrValue{Type: ATTR_TYPE_STRING, Str: "com.example.app"}},
+			{Name: "versionCode", Value: AttrValue{Type: ATTR_TYPE_INT_DEC, Int: 7}},
+		},
+		Children: []*AXMLNode{
+			{
+				Name: "application",
+				Attributes: []AXMLAttribute{
+					{Name: "label", Value: AttrValue{Type: ATTR_TYPE_STRING, Str: "Example"}},
+				},
+			},
+		},
+	}
+	a := AXML{Root: root}
+
+	data, err := a.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	got, err := ReadAXML(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadAXML: %v", err)
+	}
+
+	if got.Root == nil {
+		t.Fatal("ReadAXML: Root is nil")
+	}
+	if got.Root.Name != "manifest" {
+		t.Errorf("Root.Name = %q, want %q", got.Root.Name, "manifest")
+	}
+	if len(got.Root.Attributes) != 2 {
+		t.Fatalf("Root has %d attributes, want 2", len(got.Root.Attributes))
+	}
+	if name, value := got.Root.Attributes[0].Name, got.Root.Attributes[0].Value; name != "package" || value.Str != "com.example.app" {
+		t.Errorf("Attributes[0] = %q:%+v, want package:com.example.app", name, value)
+	}
+	if name, value := got.Root.Attributes[1].Name, got.Root.Attributes[1].Value; name != "versionCode" || value.Int != 7 {
+		t.Errorf("Attributes[1] = %q:%+v, want versionCode:7", name, value)
+	}
+
+	if len(got.Root.Children) != 1 || got.Root.Children[0].Name != "application" {
+		t.Fatalf("Root.Children = %+v, want one application child", got.Root.Children)
+	}
+	child := got.Root.Children[0]
+	if len(child.Attributes) != 1 || child.Attributes[0].Name != "label" || child.Attributes[0].Value.Str != "Example" {
+		t.Errorf("application attributes = %+v, want label:Example", child.Attributes)
+	}
+}
+
+// TestReadAXMLOutOfRangeStringIndex feeds ReadAXML a CHUNK_XML_START_TAG
+// whose nameIdx points past the end of an empty string pool. Every
+// Strings[idx] lookup is attacker controlled, so this must come back as an
+// error, not a panic.
+func TestReadAXMLOutOfRangeStringIndex(t *testing.T) {
+	pool := axml.StringPoolBlock{}
+	poolBytes, err := pool.MarshalBinary()
+	if err != nil {
+		t.Fatalf("StringPoolBlock.MarshalBinary: %v", err)
+	}
+
+	tag := axml.StartTagBlock{NsIdx: axml.SKIP_BLOCK, NameIdx: 99}
+	tagBytes, err := tag.MarshalBinary()
+	if err != nil {
+		t.Fatalf("StartTagBlock.MarshalBinary: %v", err)
+	}
+
+	endTag := axml.EndTagBlock{NsIdx: axml.SKIP_BLOCK, NameIdx: 99}
+	endTagBytes, err := endTag.MarshalBinary()
+	if err != nil {
+		t.Fatalf("EndTagBlock.MarshalBinary: %v", err)
+	}
+
+	var body bytes.Buffer
+	body.Write(poolBytes)
+	body.Write(tagBytes)
+	body.Write(endTagBytes)
+
+	var buf bytes.Buffer
+	header := uint32(CHUNK_AXML_FILE)
+	fileSize := uint32(8 + body.Len())
+	binary.Write(&buf, binary.LittleEndian, &header)
+	binary.Write(&buf, binary.LittleEndian, &fileSize)
+	buf.Write(body.Bytes())
+
+	if _, err := ReadAXML(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("ReadAXML: want an error for an out-of-range string index, got nil")
+	}
+}
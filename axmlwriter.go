@@ -0,0 +1,189 @@
+package apkdig
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/joeleonjr/apkdig/axml"
+)
+
+// InternString returns the index of s in a.Strings, appending it if it is
+// not already present. Use this before patching the tree (e.g. adding a
+// permission or activity) so the new name or value has a valid string index
+// once MarshalBinary runs.
+func (a *AXML) InternString(s string) uint32 {
+	for i, existing := range a.Strings {
+		if existing == s {
+			return uint32(i)
+		}
+	}
+	a.Strings = append(a.Strings, s)
+	return uint32(len(a.Strings) - 1)
+}
+
+// MarshalBinary serializes the parsed (and possibly patched) tree back into
+// Android's binary AndroidManifest.xml form: a string pool built from
+// a.Strings followed by the CHUNK_XML_* chunks for a.Root, wrapped in the
+// outer CHUNK_AXML_FILE header.
+func (a *AXML) MarshalBinary() ([]byte, error) {
+	if a.Root == nil {
+		return nil, errors.New("AXML has no root element")
+	}
+	var body bytes.Buffer
+	if err := a.marshalNode(&body, a.Root, map[string]string{}); err != nil {
+		return nil, err
+	}
+
+	// marshalNode interns every name and string-typed attribute value it
+	// encounters via InternString, which can append to a.Strings; the pool
+	// must be built from the final a.Strings, after that has run.
+	pool := axml.StringPoolBlock{Strings: a.Strings}
+	poolBytes, err := pool.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	fileSize := uint32(8 + len(poolBytes) + body.Len())
+	buf := bytes.NewBuffer(nil)
+	header := uint32(CHUNK_AXML_FILE)
+	binary.Write(buf, binary.LittleEndian, &header)
+	binary.Write(buf, binary.LittleEndian, &fileSize)
+	buf.Write(poolBytes)
+	buf.Write(body.Bytes())
+	return buf.Bytes(), nil
+}
+
+// marshalNode appends the CHUNK_XML_START_NAMESPACE, CHUNK_XML_START_TAG,
+// CHUNK_XML_TEXT (if node.Text is set), children, CHUNK_XML_END_TAG and
+// CHUNK_XML_END_NAMESPACE chunks for node to
+// buf. scope maps the namespace prefixes currently in effect to their URI,
+// so that node.Namespace (and its attributes') prefixes can be resolved back
+// to the string-pool index Android expects.
+func (a *AXML) marshalNode(buf *bytes.Buffer, node *AXMLNode, scope map[string]string) error {
+	prefixes := make([]string, 0, len(node.xmlns))
+	for prefix := range node.xmlns {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	child := make(map[string]string, len(scope)+len(prefixes))
+	for prefix, uri := range scope {
+		child[prefix] = uri
+	}
+	for _, prefix := range prefixes {
+		uri := node.xmlns[prefix]
+		child[prefix] = uri
+		nsBlock := axml.StartNamespaceBlock{
+			LineNumber: node.LineNumber,
+			PrefixIdx:  a.InternString(prefix),
+			UriIdx:     a.InternString(uri),
+		}
+		data, err := nsBlock.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	tag := axml.StartTagBlock{
+		LineNumber: node.LineNumber,
+		NsIdx:      axml.SKIP_BLOCK,
+		NameIdx:    a.InternString(node.Name),
+	}
+	if uri, ok := child[node.Namespace]; ok {
+		tag.NsIdx = a.InternString(uri)
+	}
+	for _, attr := range node.Attributes {
+		axmlAttr := axml.Attribute{
+			NsIdx:       axml.SKIP_BLOCK,
+			NameIdx:     a.InternString(attr.Name),
+			ValueString: axml.SKIP_BLOCK,
+			AValueType:  uint32(attr.Value.Type),
+		}
+		if uri, ok := child[attr.Namespace]; ok {
+			axmlAttr.NsIdx = a.InternString(uri)
+		}
+		switch attr.Value.Type {
+		case ATTR_TYPE_STRING:
+			axmlAttr.ValueString = a.InternString(attr.Value.Str)
+			axmlAttr.AValue = axmlAttr.ValueString
+		case ATTR_TYPE_REFERENCE:
+			axmlAttr.AValue = attr.Value.Reference
+		case ATTR_TYPE_INT_DEC, ATTR_TYPE_INT_HEX:
+			axmlAttr.AValue = uint32(attr.Value.Int)
+		case ATTR_TYPE_INT_BOOLEAN:
+			if attr.Value.Bool {
+				axmlAttr.AValue = 0xFFFFFFFF
+			}
+		case ATTR_TYPE_FLOAT:
+			axmlAttr.AValue = math.Float32bits(attr.Value.Float)
+		case ATTR_TYPE_INT_COLOR_ARGB8, ATTR_TYPE_INT_COLOR_RGB8:
+			axmlAttr.AValue = attr.Value.Color
+		default:
+			axmlAttr.AValue = uint32(attr.Value.Int)
+		}
+		tag.Attributes = append(tag.Attributes, axmlAttr)
+	}
+	data, err := tag.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+
+	if node.Text != "" {
+		text := axml.TextBlock{LineNumber: node.LineNumber, TextIdx: a.InternString(node.Text)}
+		data, err := text.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	for _, c := range node.Children {
+		if err := a.marshalNode(buf, c, child); err != nil {
+			return err
+		}
+	}
+
+	endTag := axml.EndTagBlock{LineNumber: node.LineNumber, NsIdx: tag.NsIdx, NameIdx: tag.NameIdx}
+	data, err = endTag.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+
+	for i := len(prefixes) - 1; i >= 0; i-- {
+		prefix := prefixes[i]
+		endNs := axml.EndNamespaceBlock{
+			LineNumber: node.LineNumber,
+			PrefixIdx:  a.InternString(prefix),
+			UriIdx:     a.InternString(child[prefix]),
+		}
+		data, err := endNs.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	return nil
+}
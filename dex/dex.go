@@ -0,0 +1,348 @@
+package dex
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// headerSize is the fixed size of a DEX header (everything up to and
+// including data_off).
+const headerSize = 0x70
+
+// magicPrefix is the first 4 bytes of every DEX file; the following 4 bytes
+// are a 3-digit format version and a NUL, e.g. "035\x00".
+var magicPrefix = []byte("dex\n")
+
+/*          DEX header
+ * +-----------------------------------+
+ * | magic            [8]byte          |
+ * | checksum         uint32 // adler32 over signature..EOF |
+ * | signature        [20]byte // sha1 over file_size..EOF  |
+ * | fileSize         uint32           |
+ * | headerSize       uint32 = 0x70    |
+ * | endianTag        uint32 = 0x12345678 |
+ * | linkSize         uint32           |
+ * | linkOff          uint32           |
+ * | mapOff           uint32           |
+ * | stringIdsSize    uint32           |
+ * | stringIdsOff     uint32           |
+ * | typeIdsSize      uint32           |
+ * | typeIdsOff       uint32           |
+ * | protoIdsSize     uint32           |
+ * | protoIdsOff      uint32           |
+ * | fieldIdsSize     uint32           |
+ * | fieldIdsOff      uint32           |
+ * | methodIdsSize    uint32           |
+ * | methodIdsOff     uint32           |
+ * | classDefsSize    uint32           |
+ * | classDefsOff     uint32           |
+ * | dataSize         uint32           |
+ * | dataOff          uint32           |
+ * +-----------------------------------+
+ */
+
+// StringID is one entry of the string_ids table: a reference to a
+// string_data_item elsewhere in the file. Value is the already-decoded
+// string; callers never see the raw offset.
+type StringID struct {
+	Value string
+
+	// dataOff is this entry's original string_data_off, used by Marshal to
+	// relocate it along with the rest of the file's data section. It is
+	// zero (and unused) for entries added via (*DEX).AddString, which get
+	// fresh string_data_item bytes written to a new appendix instead.
+	dataOff uint32
+	added   bool
+}
+
+// TypeID is one entry of the type_ids table: a class/array/primitive type
+// descriptor, named by its index into StringIds.
+type TypeID struct {
+	DescriptorIdx uint32
+}
+
+// ProtoID is one entry of the proto_ids table: a method prototype.
+type ProtoID struct {
+	ShortyIdx     uint32
+	ReturnTypeIdx uint32
+
+	// ParametersOff is the original type_list offset for this prototype's
+	// parameters, or 0 if it takes none. Every ProtoID (*DEX).addProto
+	// creates is parameterless, so this is always either an original,
+	// unmodified offset or 0.
+	ParametersOff uint32
+}
+
+// FieldID is one entry of the field_ids table.
+type FieldID struct {
+	ClassIdx uint16
+	TypeIdx  uint16
+	NameIdx  uint32
+}
+
+// MethodID is one entry of the method_ids table.
+type MethodID struct {
+	ClassIdx uint16
+	ProtoIdx uint16
+	NameIdx  uint32
+}
+
+// ClassDef is one entry of the class_defs table. InterfacesOff,
+// AnnotationsOff, ClassDataOff and StaticValuesOff are offsets into the
+// file's data section, or 0 if absent.
+type ClassDef struct {
+	ClassIdx        uint32
+	AccessFlags     uint32
+	SuperclassIdx   uint32
+	InterfacesOff   uint32
+	SourceFileIdx   uint32
+	AnnotationsOff  uint32
+	ClassDataOff    uint32
+	StaticValuesOff uint32
+}
+
+// DEX is a parsed classes.dex. Its five id tables and class_defs can be read directly;
+// patch them with AddString/AddMethod and write the result back out with
+// Marshal.
+type DEX struct {
+	Checksum  uint32
+	Signature [20]byte
+
+	LinkSize uint32
+	LinkOff  uint32
+	MapOff   uint32
+
+	StringIds []StringID
+	TypeIds   []TypeID
+	ProtoIds  []ProtoID
+	FieldIds  []FieldID
+	MethodIds []MethodID
+	ClassDefs []ClassDef
+
+	// data is everything in the original file from its data_off onward
+	// (map, type lists, annotations, class data, code, debug info, ...)
+	// kept as an untouched byte range. Marshal relocates it as a single
+	// unit and shifts the absolute offsets held in the header and id tables
+	// that point into it by the same delta, rather than re-encoding its
+	// contents; offsets stored inside the data section are not changed.
+	data    []byte
+	dataOff uint32
+}
+
+// ReadDEX parses a classes.dex file.
+func ReadDEX(reader io.ReadSeeker) (*DEX, error) {
+	var magic [8]byte
+	if _, err := io.ReadFull(reader, magic[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic[:4], magicPrefix) {
+		return nil, errors.New("dex: bad magic")
+	}
+
+	d := &DEX{}
+	var fileSize, hdrSize, endianTag uint32
+	var stringIdsSize, stringIdsOff uint32
+	var typeIdsSize, typeIdsOff uint32
+	var protoIdsSize, protoIdsOff uint32
+	var fieldIdsSize, fieldIdsOff uint32
+	var methodIdsSize, methodIdsOff uint32
+	var classDefsSize, classDefsOff uint32
+	var dataSize uint32
+
+	r := newByteReader(reader)
+	r.read(&d.Checksum)
+	r.read(&d.Signature)
+	r.read(&fileSize)
+	r.read(&hdrSize)
+	r.read(&endianTag)
+	r.read(&d.LinkSize)
+	r.read(&d.LinkOff)
+	r.read(&d.MapOff)
+	r.read(&stringIdsSize)
+	r.read(&stringIdsOff)
+	r.read(&typeIdsSize)
+	r.read(&typeIdsOff)
+	r.read(&protoIdsSize)
+	r.read(&protoIdsOff)
+	r.read(&fieldIdsSize)
+	r.read(&fieldIdsOff)
+	r.read(&methodIdsSize)
+	r.read(&methodIdsOff)
+	r.read(&classDefsSize)
+	r.read(&classDefsOff)
+	r.read(&dataSize)
+	r.read(&d.dataOff)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if hdrSize != headerSize {
+		return nil, fmt.Errorf("dex: expected header_size=%#x, got %#x", headerSize, hdrSize)
+	}
+	if endianTag != 0x12345678 {
+		return nil, fmt.Errorf("dex: expected endian_tag=%#x, got %#x (big-endian dex is not supported)", 0x12345678, endianTag)
+	}
+
+	if _, err := reader.Seek(int64(stringIdsOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.StringIds = make([]StringID, stringIdsSize)
+	for i := range d.StringIds {
+		var off uint32
+		r.read(&off)
+		d.StringIds[i].dataOff = off
+	}
+	for i := range d.StringIds {
+		s, err := readMUTF8(reader, d.StringIds[i].dataOff)
+		if err != nil {
+			return nil, err
+		}
+		d.StringIds[i].Value = s
+	}
+
+	if _, err := reader.Seek(int64(typeIdsOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.TypeIds = make([]TypeID, typeIdsSize)
+	for i := range d.TypeIds {
+		r.read(&d.TypeIds[i].DescriptorIdx)
+	}
+
+	if _, err := reader.Seek(int64(protoIdsOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.ProtoIds = make([]ProtoID, protoIdsSize)
+	for i := range d.ProtoIds {
+		r.read(&d.ProtoIds[i].ShortyIdx)
+		r.read(&d.ProtoIds[i].ReturnTypeIdx)
+		r.read(&d.ProtoIds[i].ParametersOff)
+	}
+
+	if _, err := reader.Seek(int64(fieldIdsOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.FieldIds = make([]FieldID, fieldIdsSize)
+	for i := range d.FieldIds {
+		r.read(&d.FieldIds[i].ClassIdx)
+		r.read(&d.FieldIds[i].TypeIdx)
+		r.read(&d.FieldIds[i].NameIdx)
+	}
+
+	if _, err := reader.Seek(int64(methodIdsOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.MethodIds = make([]MethodID, methodIdsSize)
+	for i := range d.MethodIds {
+		r.read(&d.MethodIds[i].ClassIdx)
+		r.read(&d.MethodIds[i].ProtoIdx)
+		r.read(&d.MethodIds[i].NameIdx)
+	}
+
+	if _, err := reader.Seek(int64(classDefsOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	d.ClassDefs = make([]ClassDef, classDefsSize)
+	for i := range d.ClassDefs {
+		r.read(&d.ClassDefs[i].ClassIdx)
+		r.read(&d.ClassDefs[i].AccessFlags)
+		r.read(&d.ClassDefs[i].SuperclassIdx)
+		r.read(&d.ClassDefs[i].InterfacesOff)
+		r.read(&d.ClassDefs[i].SourceFileIdx)
+		r.read(&d.ClassDefs[i].AnnotationsOff)
+		r.read(&d.ClassDefs[i].ClassDataOff)
+		r.read(&d.ClassDefs[i].StaticValuesOff)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if _, err := reader.Seek(int64(d.dataOff), io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	d.data = data
+	_ = dataSize // data is kept through EOF rather than truncated to dataSize; see the data field's doc comment.
+
+	return d, nil
+}
+
+// readMUTF8 reads a string_data_item at off: a ULEB128 UTF-16 length
+// followed by modified-UTF-8 bytes and a NUL terminator. The UTF-16 length
+// is only needed to write the item back out, so it is discarded here.
+func readMUTF8(reader io.ReadSeeker, off uint32) (string, error) {
+	if _, err := reader.Seek(int64(off), io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := readULEB128(reader); err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			break
+		}
+		buf.WriteByte(b[0])
+	}
+	return buf.String(), nil
+}
+
+// byteReader is a small helper around binary.Read that sticks the first
+// error it hits so a chain of sequential header reads can be checked once
+// at the end, the same pattern arsc.byteReader uses.
+type byteReader struct {
+	r   io.Reader
+	err error
+}
+
+func newByteReader(r io.Reader) *byteReader {
+	return &byteReader{r: r}
+}
+
+func (b *byteReader) read(v interface{}) {
+	if b.err != nil {
+		return
+	}
+	b.err = binary.Read(b.r, binary.LittleEndian, v)
+}
+
+func readULEB128(r io.Reader) (uint32, error) {
+	var result uint32
+	var shift uint
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, err
+		}
+		result |= uint32(b[0]&0x7F) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	return result, nil
+}
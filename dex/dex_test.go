@@ -0,0 +1,138 @@
+package dex
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"hash/adler32"
+	"testing"
+	"unicode/utf16"
+)
+
+func uleb128(v uint32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			out = append(out, b|0x80)
+		} else {
+			return append(out, b)
+		}
+	}
+}
+
+func stringDataItem(s string) []byte {
+	buf := uleb128(uint32(len(utf16.Encode([]rune(s)))))
+	buf = append(buf, []byte(s)...)
+	return append(buf, 0)
+}
+
+// buildMinimalDEX returns a syntactically valid classes.dex with one string
+// ("Lcom/example/Foo;"), one type referencing it, and no protos, fields,
+// methods or class_defs, to exercise AddMethod/Marshal against.
+func buildMinimalDEX(t *testing.T) []byte {
+	t.Helper()
+	strs := []string{"Lcom/example/Foo;"}
+	stringIdsOff := uint32(headerSize)
+	typeIdsOff := stringIdsOff + 4*uint32(len(strs))
+	dataOff := typeIdsOff + 4
+
+	var data bytes.Buffer
+	stringOff := dataOff + uint32(data.Len())
+	data.Write(stringDataItem(strs[0]))
+
+	var header bytes.Buffer
+	header.Write(magicPrefix)
+	header.Write([]byte("035\x00"))
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // checksum
+	header.Write(make([]byte, 20))                        // signature
+	fileSize := dataOff + uint32(data.Len())
+	binary.Write(&header, binary.LittleEndian, fileSize)
+	binary.Write(&header, binary.LittleEndian, uint32(headerSize))
+	binary.Write(&header, binary.LittleEndian, uint32(0x12345678))
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // link_size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // link_off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // map_off
+	binary.Write(&header, binary.LittleEndian, uint32(len(strs)))
+	binary.Write(&header, binary.LittleEndian, stringIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(1))
+	binary.Write(&header, binary.LittleEndian, typeIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // proto_ids size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // proto_ids off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // field_ids size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // field_ids off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // method_ids size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // method_ids off
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // class_defs size
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // class_defs off
+	binary.Write(&header, binary.LittleEndian, uint32(data.Len()))
+	binary.Write(&header, binary.LittleEndian, dataOff)
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, stringOff)
+	binary.Write(&body, binary.LittleEndian, uint32(0)) // type_ids[0].descriptor_idx
+	body.Write(data.Bytes())
+
+	return append(header.Bytes(), body.Bytes()...)
+}
+
+// TestMarshalChecksumAndSignature checks that Marshal's output is internally
+// consistent: the header's checksum is the Adler-32 of everything from the
+// signature field onward, and the signature is the SHA-1 of everything from
+// file_size onward, exactly as the DEX format requires.
+func TestMarshalChecksumAndSignature(t *testing.T) {
+	d, err := ReadDEX(bytes.NewReader(buildMinimalDEX(t)))
+	if err != nil {
+		t.Fatalf("ReadDEX: %v", err)
+	}
+
+	methodIdx := d.AddMethod("Lcom/example/Foo;", "<clinit>", "V")
+
+	var out bytes.Buffer
+	if err := d.Marshal(&out); err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	raw := out.Bytes()
+
+	wantChecksum := adler32.Checksum(raw[12:])
+	if gotChecksum := binary.LittleEndian.Uint32(raw[8:12]); gotChecksum != wantChecksum {
+		t.Errorf("checksum = %#x, want %#x", gotChecksum, wantChecksum)
+	}
+	wantSig := sha1.Sum(raw[32:])
+	if !bytes.Equal(raw[12:32], wantSig[:]) {
+		t.Errorf("signature = %x, want %x", raw[12:32], wantSig)
+	}
+
+	d2, err := ReadDEX(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("re-parsing Marshal output: %v", err)
+	}
+	m := d2.MethodIds[methodIdx]
+	if name := d2.StringIds[m.NameIdx].Value; name != "<clinit>" {
+		t.Errorf("method name = %q, want %q", name, "<clinit>")
+	}
+	if class := d2.StringIds[d2.TypeIds[m.ClassIdx].DescriptorIdx].Value; class != "Lcom/example/Foo;" {
+		t.Errorf("method class = %q, want %q", class, "Lcom/example/Foo;")
+	}
+	proto := d2.ProtoIds[m.ProtoIdx]
+	if shorty := d2.StringIds[proto.ShortyIdx].Value; shorty != "V" {
+		t.Errorf("method proto shorty = %q, want %q", shorty, "V")
+	}
+}
@@ -0,0 +1,291 @@
+package dex
+
+/*
+ * Copyright (c) 2014 Floor Terra <floort@gmail.com>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"unicode/utf16"
+)
+
+// AddString returns the index of s in d.StringIds, appending it (and
+// queuing its string_data_item for the appendix Marshal writes after the
+// file's relocated data section) if it is not already present.
+//
+// Appending rather than inserting in sorted order means string_ids (and, by
+// extension, type_ids/proto_ids/method_ids built from it) is no longer
+// strictly ascending once this is called, which the real DEX format
+// requires; see the warning on Marshal.
+func (d *DEX) AddString(s string) uint32 {
+	for i, id := range d.StringIds {
+		if id.Value == s {
+			return uint32(i)
+		}
+	}
+	d.StringIds = append(d.StringIds, StringID{Value: s, added: true})
+	return uint32(len(d.StringIds) - 1)
+}
+
+// addType returns the index of a TypeID for descriptor (e.g.
+// "Lcom/example/Foo;"), adding one (and interning descriptor as a string)
+// if it is not already present.
+func (d *DEX) addType(descriptor string) uint32 {
+	descIdx := d.AddString(descriptor)
+	for i, t := range d.TypeIds {
+		if t.DescriptorIdx == descIdx {
+			return uint32(i)
+		}
+	}
+	d.TypeIds = append(d.TypeIds, TypeID{DescriptorIdx: descIdx})
+	return uint32(len(d.TypeIds) - 1)
+}
+
+// shortyToDescriptor maps a proto shorty's return-type character to the
+// type descriptor addProto interns a TypeID for.
+var shortyToDescriptor = map[byte]string{
+	'V': "V", 'Z': "Z", 'B': "B", 'S': "S", 'C': "C",
+	'I': "I", 'J': "J", 'F': "F", 'D': "D",
+}
+
+// addProto returns the index of a parameterless ProtoID whose shorty is
+// shorty (e.g. "V" for a no-argument method returning void), adding one if
+// it is not already present. AddMethod only ever needs parameterless
+// prototypes (the shape of a <clinit> call site into an injected static
+// initializer), so that is the only kind this package can construct; an
+// existing ProtoID read from the file may of course have parameters.
+func (d *DEX) addProto(shorty string) uint32 {
+	shortyIdx := d.AddString(shorty)
+	descriptor, ok := shortyToDescriptor[shorty[len(shorty)-1]]
+	if !ok {
+		descriptor = "Ljava/lang/Object;"
+	}
+	returnTypeIdx := d.addType(descriptor)
+	for i, p := range d.ProtoIds {
+		if p.ShortyIdx == shortyIdx && p.ReturnTypeIdx == returnTypeIdx && p.ParametersOff == 0 {
+			return uint32(i)
+		}
+	}
+	d.ProtoIds = append(d.ProtoIds, ProtoID{ShortyIdx: shortyIdx, ReturnTypeIdx: returnTypeIdx})
+	return uint32(len(d.ProtoIds) - 1)
+}
+
+// AddMethod interns class's and name's strings and a parameterless
+// prototype for proto (a shorty such as "V"), then returns the index of the
+// resulting MethodID, reusing an existing one if all three already match.
+func (d *DEX) AddMethod(class, name, proto string) uint32 {
+	classIdx := d.addType(class)
+	nameIdx := d.AddString(name)
+	protoIdx := d.addProto(proto)
+	for i, m := range d.MethodIds {
+		if uint32(m.ClassIdx) == classIdx && m.NameIdx == nameIdx && uint32(m.ProtoIdx) == protoIdx {
+			return uint32(i)
+		}
+	}
+	d.MethodIds = append(d.MethodIds, MethodID{
+		ClassIdx: uint16(classIdx),
+		ProtoIdx: uint16(protoIdx),
+		NameIdx:  nameIdx,
+	})
+	return uint32(len(d.MethodIds) - 1)
+}
+
+// Marshal writes d back out as a classes.dex. The five fixed-size id tables
+// and class_defs are re-emitted at the same layout they'd have in a freshly
+// generated dex (immediately after the header, in d's field order); d.data,
+// the original data section, is relocated as a single unrecoded unit right
+// after them, with the absolute offsets outside it that point into it
+// (string string_data_off, proto parameters_off, class_def's four data
+// offsets, link_off and map_off) shifted by the resulting delta. Offsets
+// stored inside the data section itself (map_list entries, class_data_item
+// code offsets, annotation and type-list references) are copied unchanged,
+// and the map_list is not updated for added entries. Strings added since
+// the file was read get fresh string_data_items appended after the
+// relocated data, in a trailing appendix; added protos have no parameter
+// list (parameters_off 0).
+//
+// WARNING: the DEX format requires string_ids/type_ids/proto_ids/field_ids/
+// method_ids to be sorted ascending, and Marshal does not re-sort them —
+// AddString/addType/AddMethod all append rather than insert in order. A
+// file with entries added this way will fail ART's dex verifier and cannot
+// be loaded on a device; Marshal's output is only valid for offline
+// inspection (e.g. feeding back into ReadDEX) until re-sorting with
+// cross-reference fixup is implemented.
+func (d *DEX) Marshal(w io.Writer) error {
+	stringIdsOff := uint32(headerSize)
+	typeIdsOff := stringIdsOff + 4*uint32(len(d.StringIds))
+	protoIdsOff := typeIdsOff + 4*uint32(len(d.TypeIds))
+	fieldIdsOff := protoIdsOff + 12*uint32(len(d.ProtoIds))
+	methodIdsOff := fieldIdsOff + 8*uint32(len(d.FieldIds))
+	classDefsOff := methodIdsOff + 8*uint32(len(d.MethodIds))
+	newDataOff := classDefsOff + 32*uint32(len(d.ClassDefs))
+
+	delta := int64(newDataOff) - int64(d.dataOff)
+	shift := func(off uint32) uint32 {
+		if off == 0 {
+			return 0
+		}
+		return uint32(int64(off) + delta)
+	}
+
+	appendix, stringOff, err := d.buildAppendix(newDataOff + uint32(len(d.data)))
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	for _, id := range d.StringIds {
+		off := id.dataOff
+		if id.added {
+			off = stringOff[id.Value]
+		} else {
+			off = shift(off)
+		}
+		binary.Write(&body, binary.LittleEndian, off)
+	}
+	for _, t := range d.TypeIds {
+		binary.Write(&body, binary.LittleEndian, t.DescriptorIdx)
+	}
+	for _, p := range d.ProtoIds {
+		binary.Write(&body, binary.LittleEndian, p.ShortyIdx)
+		binary.Write(&body, binary.LittleEndian, p.ReturnTypeIdx)
+		binary.Write(&body, binary.LittleEndian, shift(p.ParametersOff))
+	}
+	for _, f := range d.FieldIds {
+		binary.Write(&body, binary.LittleEndian, f.ClassIdx)
+		binary.Write(&body, binary.LittleEndian, f.TypeIdx)
+		binary.Write(&body, binary.LittleEndian, f.NameIdx)
+	}
+	for _, m := range d.MethodIds {
+		binary.Write(&body, binary.LittleEndian, m.ClassIdx)
+		binary.Write(&body, binary.LittleEndian, m.ProtoIdx)
+		binary.Write(&body, binary.LittleEndian, m.NameIdx)
+	}
+	for _, c := range d.ClassDefs {
+		binary.Write(&body, binary.LittleEndian, c.ClassIdx)
+		binary.Write(&body, binary.LittleEndian, c.AccessFlags)
+		binary.Write(&body, binary.LittleEndian, c.SuperclassIdx)
+		binary.Write(&body, binary.LittleEndian, shift(c.InterfacesOff))
+		binary.Write(&body, binary.LittleEndian, c.SourceFileIdx)
+		binary.Write(&body, binary.LittleEndian, shift(c.AnnotationsOff))
+		binary.Write(&body, binary.LittleEndian, shift(c.ClassDataOff))
+		binary.Write(&body, binary.LittleEndian, shift(c.StaticValuesOff))
+	}
+	body.Write(d.data)
+	body.Write(appendix)
+
+	fileSize := uint32(headerSize) + uint32(body.Len())
+	var header bytes.Buffer
+	header.Write(magicPrefix)
+	header.Write([]byte("035\x00"))
+	binary.Write(&header, binary.LittleEndian, uint32(0)) // checksum, patched below
+	header.Write(make([]byte, 20))                        // signature, patched below
+	binary.Write(&header, binary.LittleEndian, fileSize)
+	binary.Write(&header, binary.LittleEndian, uint32(headerSize))
+	binary.Write(&header, binary.LittleEndian, uint32(0x12345678))
+	binary.Write(&header, binary.LittleEndian, d.LinkSize)
+	binary.Write(&header, binary.LittleEndian, shift(d.LinkOff))
+	binary.Write(&header, binary.LittleEndian, shift(d.MapOff))
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.StringIds)))
+	binary.Write(&header, binary.LittleEndian, stringIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.TypeIds)))
+	binary.Write(&header, binary.LittleEndian, typeIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.ProtoIds)))
+	binary.Write(&header, binary.LittleEndian, protoIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.FieldIds)))
+	binary.Write(&header, binary.LittleEndian, fieldIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.MethodIds)))
+	binary.Write(&header, binary.LittleEndian, methodIdsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.ClassDefs)))
+	binary.Write(&header, binary.LittleEndian, classDefsOff)
+	binary.Write(&header, binary.LittleEndian, uint32(len(d.data)+len(appendix)))
+	binary.Write(&header, binary.LittleEndian, newDataOff)
+
+	out := append(header.Bytes(), body.Bytes()...)
+
+	sig := sha1.Sum(out[32:])
+	copy(out[12:32], sig[:])
+	checksum := adler32.Checksum(out[12:])
+	binary.LittleEndian.PutUint32(out[8:12], checksum)
+
+	_, err = w.Write(out)
+	return err
+}
+
+// buildAppendix encodes a string_data_item for every StringID added via
+// AddString, starting at off, and returns the resulting bytes along with
+// the absolute offset each added string's item ended up at.
+func (d *DEX) buildAppendix(off uint32) ([]byte, map[string]uint32, error) {
+	var buf bytes.Buffer
+	offsets := make(map[string]uint32)
+	for _, id := range d.StringIds {
+		if !id.added {
+			continue
+		}
+		offsets[id.Value] = off + uint32(buf.Len())
+		units := utf16.Encode([]rune(id.Value))
+		writeULEB128(&buf, uint32(len(units)))
+		if err := writeMUTF8(&buf, id.Value); err != nil {
+			return nil, nil, err
+		}
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), offsets, nil
+}
+
+// writeMUTF8 appends s's modified-UTF-8 encoding to buf. Modified UTF-8
+// differs from ordinary UTF-8 in two ways: an embedded NUL byte uses the
+// overlong 0xC0 0x80 form instead of a literal zero byte, since a literal
+// zero would be mistaken for the string_data_item's terminator, and
+// supplementary-plane characters are split into a UTF-16 surrogate pair
+// with each half CESU-8 encoded separately rather than written as one
+// 4-byte UTF-8 sequence. This package's reader, readMUTF8, only strips a
+// literal NUL terminator and otherwise copies bytes through unchanged, so
+// the 0xC0 0x80 form this function writes for an embedded NUL won't decode
+// back to one; that mismatch is accepted because it's what real MUTF-8
+// requires regardless of what this package's reader understands. The
+// surrogate-pair case has no such justification to fall back on, so rather
+// than emit it incorrectly, reject it.
+func writeMUTF8(buf *bytes.Buffer, s string) error {
+	for _, r := range s {
+		switch {
+		case r == 0:
+			buf.Write([]byte{0xC0, 0x80})
+		case r > 0xFFFF:
+			return fmt.Errorf("dex: %q contains a supplementary-plane character, which this package cannot encode as modified UTF-8", s)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return nil
+}
+
+func writeULEB128(buf *bytes.Buffer, v uint32) {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v != 0 {
+			buf.WriteByte(b | 0x80)
+		} else {
+			buf.WriteByte(b)
+			return
+		}
+	}
+}